@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// combineSplitReports writes the -split reports of fileNames to the
+// -combine file, as one report, without looking anything up again.
+func combineSplitReports(fileNames []string) error {
+	var reportNames []string
+	for _, fileName := range fileNames {
+		if fileName == stdinName || isURL(fileName) {
+			return fmt.Errorf("-combine can't find the -split report of %s", fileName)
+		}
+		reportNames = append(reportNames, splitReportName(fileName, *outputFormat, *compress))
+	}
+
+	report, err := openReport(*combineFile, *noClobber, false, *compress)
+	if err != nil {
+		return err
+	}
+	err = combineReports(report, *outputFormat, !*noHeader, reportNames)
+	closeErr := report.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	slog.Info("Combined reports", "file", *combineFile, "reports", len(reportNames))
+	return nil
+}
+
+// combineReports writes the reports in fileNames, which may be gzipped, to
+// w as one report in format. With header, csv and tsv reports must have
+// the same columns: the header of the first is written once, and the rows
+// of any with its columns in another order are reordered to match. flatjson
+// reports must have the same keys. Without header, and for json, reports
+// are only joined together. Empty reports are skipped.
+func combineReports(w io.Writer, format string, header bool, fileNames []string) error {
+	if format == "xlsx" {
+		return errors.New("xlsx reports can't be combined")
+	}
+
+	var combined combinedReport
+	for _, fileName := range fileNames {
+		file, err := openInput(fileName)
+		if err != nil {
+			return err
+		}
+		err = combined.add(w, format, header, fileName, bufio.NewReader(file))
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	return nil
+}
+
+// combinedReport keeps the columns, or flatjson keys, of the first report
+// combined, to check the others against.
+type combinedReport struct {
+	first   string
+	columns []string
+}
+
+func (combined *combinedReport) add(w io.Writer, format string, header bool, fileName string, r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if line == "" {
+		return nil
+	}
+
+	switch {
+	case (format == "csv" || format == "tsv") && header:
+		comma := ','
+		if format == "tsv" {
+			comma = '\t'
+		}
+		columns, err := readHeader(line, comma)
+		if err != nil {
+			return err
+		}
+		if combined.columns == nil {
+			combined.first, combined.columns = fileName, columns
+			return copyLines(w, line, r)
+		}
+		if reflect.DeepEqual(columns, combined.columns) {
+			return copyLines(w, "", r)
+		}
+		err = combined.check(columns)
+		if err != nil {
+			return err
+		}
+		return reorderRows(w, comma, columns, combined.columns, r)
+
+	case format == "flatjson":
+		var row map[string]json.RawMessage
+		err := json.Unmarshal([]byte(line), &row)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for key := range row {
+			keys = append(keys, key)
+		}
+		if combined.columns == nil {
+			combined.first, combined.columns = fileName, keys
+		} else if err := combined.check(keys); err != nil {
+			return err
+		}
+	}
+	return copyLines(w, line, r)
+}
+
+// check returns an error describing how columns differ from those of the
+// first report, if they aren't the same but for order.
+func (combined *combinedReport) check(columns []string) error {
+	found := map[string]bool{}
+	for _, column := range columns {
+		found[column] = true
+	}
+	wanted := map[string]bool{}
+	var missing []string
+	for _, column := range combined.columns {
+		wanted[column] = true
+		if !found[column] {
+			missing = append(missing, column)
+		}
+	}
+	var extra []string
+	for _, column := range columns {
+		if !wanted[column] {
+			extra = append(extra, column)
+		}
+	}
+	if len(missing) == 0 && len(extra) == 0 && len(columns) == len(combined.columns) {
+		return nil
+	}
+
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return fmt.Errorf("columns differ from %s: missing [%s], extra [%s]", combined.first, strings.Join(missing, ", "), strings.Join(extra, ", "))
+}
+
+func readHeader(line string, comma rune) ([]string, error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.Comma = comma
+	columns, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	return columns, nil
+}
+
+// copyLines writes line and then the rest of r to w, ending every line,
+// including the last, with a newline.
+func copyLines(w io.Writer, line string, r *bufio.Reader) error {
+	for {
+		if line != "" {
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			_, err := io.WriteString(w, line)
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		line, err = r.ReadString('\n')
+		if err == io.EOF {
+			if line == "" {
+				return nil
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// reorderRows writes the rows of r, which are in the order of columns, to w
+// in the order of want.
+func reorderRows(w io.Writer, comma rune, columns []string, want []string, r io.Reader) error {
+	index := map[string]int{}
+	for i, column := range columns {
+		index[column] = i
+	}
+
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.FieldsPerRecord = len(columns)
+	writer := csv.NewWriter(w)
+	writer.Comma = comma
+	row := make([]string, len(want))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for i, column := range want {
+			row[i] = record[index[column]]
+		}
+		err = writer.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
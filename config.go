@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A configValue is a flag set by a config file, with each value it is
+// given; flags that can be repeated may be given several.
+type configValue struct {
+	line   int
+	name   string
+	values []string
+}
+
+// loadConfig sets the flags of flags from a config file, except those that
+// were given on the command line, so that command line flags override the
+// file, which overrides the defaults. The file is TOML, or YAML if its name
+// ends in .yaml or .yml, with a key per flag; see parseConfig.
+func loadConfig(flags *flag.FlagSet, fileName string) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	extension := strings.ToLower(filepath.Ext(fileName))
+	configValues, err := parseConfig(data, extension == ".yaml" || extension == ".yml")
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	onCommandLine := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+
+	for _, configValue := range configValues {
+		if flags.Lookup(configValue.name) == nil || configValue.name == "config" {
+			return fmt.Errorf("%s:%d: unknown flag %q", fileName, configValue.line, configValue.name)
+		}
+		if onCommandLine[configValue.name] {
+			continue
+		}
+		for _, value := range configValue.values {
+			err := flags.Set(configValue.name, value)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", fileName, configValue.line, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseConfig reads the flat subset of TOML or YAML that a config file
+// needs: one key per line, set to a string, number or boolean, or for
+// flags that can be repeated, a list of them. Lists are inline arrays, or
+// in YAML may also be "- value" items on the lines after the key. Tables,
+// nested keys and multi-line strings aren't supported.
+func parseConfig(data []byte, yaml bool) ([]configValue, error) {
+	separator := "="
+	if yaml {
+		separator = ":"
+	}
+
+	var configValues []configValue
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || (yaml && line == "---") {
+			continue
+		}
+
+		if yaml && strings.HasPrefix(line, "- ") {
+			if len(configValues) == 0 {
+				return nil, fmt.Errorf("line %d: list item without a key", lineNumber)
+			}
+			value, err := parseConfigScalar(strings.TrimPrefix(line, "- "))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+			last := &configValues[len(configValues)-1]
+			last.values = append(last.values, value)
+			continue
+		}
+		if !yaml && strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables aren't supported, every key must be a flag", lineNumber)
+		}
+
+		name, rawValue, found := strings.Cut(line, separator)
+		name = strings.Trim(strings.TrimSpace(name), `"'`)
+		if !found || name == "" {
+			return nil, fmt.Errorf("line %d: expected name %s value", lineNumber, separator)
+		}
+
+		// A YAML key with no value starts a list of items.
+		rawValue = strings.TrimSpace(rawValue)
+		var values []string
+		if !yaml || (rawValue != "" && !strings.HasPrefix(rawValue, "#")) {
+			var err error
+			values, err = parseConfigValue(rawValue)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+			}
+		}
+		configValues = append(configValues, configValue{line: lineNumber, name: name, values: values})
+	}
+	return configValues, scanner.Err()
+}
+
+// parseConfigValue parses a value, which is a scalar or an inline array of
+// them, followed by an optional comment.
+func parseConfigValue(raw string) ([]string, error) {
+	if !strings.HasPrefix(raw, "[") {
+		value, err := parseConfigScalar(raw)
+		if err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+
+	var values []string
+	rest := strings.TrimSpace(raw[1:])
+	for !strings.HasPrefix(rest, "]") {
+		value, next, err := readConfigScalar(rest, ",]")
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		rest = strings.TrimSpace(next)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, errors.New("unterminated array")
+		}
+	}
+	return values, checkConfigComment(rest[1:])
+}
+
+// parseConfigScalar parses a single value followed by an optional comment.
+func parseConfigScalar(raw string) (string, error) {
+	value, rest, err := readConfigScalar(strings.TrimSpace(raw), "")
+	if err != nil {
+		return "", err
+	}
+	return value, checkConfigComment(rest)
+}
+
+// readConfigScalar reads a quoted or bare value from the start of s, and
+// returns it and the rest of s. A bare value ends at a comment, or at any
+// of the characters in stop.
+func readConfigScalar(s string, stop string) (value string, rest string, err error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				value, err := strconv.Unquote(s[:i+1])
+				return value, s[i+1:], err
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+
+	end := len(s)
+	if i := strings.IndexAny(s, stop); stop != "" && i >= 0 {
+		end = i
+	}
+	if i := strings.Index(s, " #"); i >= 0 && i < end {
+		end = i
+	}
+	return strings.TrimSpace(s[:end]), s[end:], nil
+}
+
+// checkConfigComment checks that what follows a value is nothing, or a
+// comment.
+func checkConfigComment(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected %q after the value", rest)
+	}
+	return nil
+}
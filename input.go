@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+type inputFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (input *inputFile) Close() error {
+	var err error
+	for _, closer := range input.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// stdinName is the file name that stands for standard input.
+const stdinName = "-"
+
+// isURL reports whether an input file name is an http or https URL, which
+// is fetched rather than opened.
+func isURL(fileName string) bool {
+	parsed, err := url.Parse(fileName)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// sourceName is how an input file is identified in the report. A URL is
+// identified by the last part of its path, or its host if it has no path.
+func sourceName(fileName string) string {
+	if fileName == stdinName {
+		return "stdin"
+	}
+	if isURL(fileName) {
+		parsed, _ := url.Parse(fileName)
+		name := path.Base(parsed.Path)
+		if name == "." || name == "/" {
+			return parsed.Host
+		}
+		return name
+	}
+	return filepath.Base(fileName)
+}
+
+func openFile(fileName string) (io.ReadCloser, error) {
+	if fileName == stdinName {
+		return os.Stdin, nil
+	}
+	if isURL(fileName) {
+		return openURL(fileName)
+	}
+	return os.Open(fileName)
+}
+
+// openURL fetches an export with a GET request, sending -input-header and
+// giving up after -input-timeout. The body is streamed, not downloaded
+// first.
+func openURL(rawURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range inputHeaders {
+		name, value, _ := strings.Cut(header, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	httpClient := &http.Client{Timeout: *inputTimeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// openInput opens an export for reading, decompressing it if it is gzipped.
+// Gzipped files are recognized by their contents, not their name.
+func openInput(fileName string) (io.ReadCloser, error) {
+	file, err := openFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	magic, _ := buffered.Peek(len(gzipMagic))
+	if !bytes.Equal(magic, gzipMagic) {
+		return &inputFile{buffered, []io.Closer{file}}, nil
+	}
+
+	gzipReader, err := gzip.NewReader(buffered)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return &inputFile{gzipReader, []io.Closer{gzipReader, file}}, nil
+}
+
+// inputSize estimates the number of bytes that reading an export will
+// produce. For gzipped files this is the uncompressed size from the gzip
+// trailer, which is only accurate for single-member files under 4GB.
+// Standard input and URLs have no known size.
+func inputSize(fileName string) (int64, error) {
+	if fileName == stdinName || isURL(fileName) {
+		return 0, nil
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	magic := make([]byte, len(gzipMagic))
+	_, err = io.ReadFull(file, magic)
+	if err != nil || !bytes.Equal(magic, gzipMagic) || fileInfo.Size() < 4 {
+		return fileInfo.Size(), nil
+	}
+
+	trailer := make([]byte, 4)
+	_, err = file.ReadAt(trailer, fileInfo.Size()-4)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint32(trailer)), nil
+}
@@ -1,295 +1,1123 @@
 package main
 
 import (
-	"bufio"
-	"encoding/csv"
+	"context"
 	"encoding/json"
 	"flag"
-	"log"
-	"net/http"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
+
+	"github.com/artudis-utils/artudis-oadoi-report/oadoi"
 )
 
-type Record struct {
-	Publication
-	APIResponses []APIResponse
-}
+// identifierColumns are the columns added with -fields-from-publication.
+var identifierColumns = []string{"identifier_scheme", "identifier_value"}
+
+// issnColumns are the columns written with -issn-only.
+var issnColumns = []string{"id", "journal_issns", "sherpa_link"}
+
+// workersPerRequest is the default number of records processed at a time
+// for each request -httplimit allows.
+const workersPerRequest = 4
+
+// version, commit and date are set at build time by goreleaser.
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+var configFile = flag.String("config", "", "File of flag settings by name, in TOML, or YAML if it ends in .yaml or .yml; flags on the command line override it")
+var showVersion = flag.Bool("version", false, "Print the version, commit and build date, and exit")
 
-type Publication struct {
-	Identifier []struct {
-		Scheme string `json:"scheme"`
-		Value  string `json:"value"`
-	} `json:"identifier"`
-	ID         string `json:"__id__"`
-	Type       string `json:"type"`
-	Attachment []struct {
-		OpenAccess  string      `json:"open_access"`
-		BlobKey     string      `json:"blob_key"`
-		ExternalURL interface{} `json:"external_url"`
-		Type        string      `json:"type"`
-	} `json:"attachment"`
+var email = flag.String("email", "", "Email to pass to the oaDOI API (default $OADOI_EMAIL)")
+var requestTimeout = flag.Duration("timeout", 30*time.Second, "Timeout for a single oaDOI request, including reading the response")
+var userAgentOverride = flag.String("user-agent", "", "User-Agent header to send instead of the default, which includes the version and email")
+var rawDir = flag.String("raw-dir", "", "Directory to archive the raw oaDOI response for each DOI in, as <doi>.json with the DOI's slashes escaped")
+var cacheDir = flag.String("cache-dir", "", "Directory to cache API responses in, keyed by DOI")
+var cacheTTL = flag.Duration("cache-ttl", 0, "Age after which cached responses are fetched again (0 to keep them forever)")
+var retries = flag.Int("retries", 3, "Number of times to retry a lookup after a network error or 5xx response")
+var maxRetryWait = flag.Duration("max-retry-wait", 5*time.Minute, "Maximum total time to wait on 429 Retry-After responses for one DOI")
+var apiURL = flag.String("api-url", oadoi.OADOIURL, "Base URL of the oaDOI API, ending with a slash")
+var doiParam = flag.String("doi-param", "", "Query parameter to pass the DOI to -api-url in, such as doi, for gateways that don't take it in the path; -api-url then needn't end with a slash")
+var caFile = flag.String("ca-file", "", "PEM file of CA certificates to trust, as well as the system's, for an -api-url mirror with a private CA")
+var insecureSkipVerify = flag.Bool("insecure-skip-verify", false, "DANGEROUS: don't verify the TLS certificates of any server, which lets anyone on the network forge oaDOI's answers; prefer -ca-file")
+var httplimit = flag.Int("httplimit", 5, "Number of HTTP requests that can run concurrently")
+var workersTotal = flag.Int("workers-total", 0, "Number of records to process at a time, which can be more than -httplimit, since records waiting to retry or answered without a request don't make one (0 for 4 times -httplimit)")
+var concurrencyAuto = flag.Bool("concurrency-auto", false, "Start at -concurrency-min requests at a time and tune that, up to -httplimit, from the latency, errors and 429s of oaDOI's responses")
+var concurrencyMin = flag.Int("concurrency-min", 1, "With -concurrency-auto, the fewest requests to run at a time")
+var rps = flag.Float64("rps", 0, "Maximum number of oaDOI requests to start per second (0 for no limit)")
+var snapshotFile = flag.String("snapshot", "", "Look DOIs up in this uncompressed Unpaywall JSONL data snapshot instead of the API")
+var apiFallback = flag.Bool("api-fallback", false, "With -snapshot, look up DOIs missing from the snapshot in the API")
+var resumeLedger = flag.String("resume-ledger", "", "File recording each DOI looked up; DOIs already in it, from an earlier run, are answered from it instead of oaDOI")
+var maxRequests = flag.Int64("max-requests", 0, "Most requests to make to oaDOI, counting retries; later DOIs are reported as quota-exceeded, and written to -dead-letter (0 for no limit)")
+var preserveDOICase = flag.Bool("preserve-doi-case", false, "Request and report DOIs in the case of the export, only stripping doi: or https://doi.org/ prefixes and whitespace; by default they are lowercased, as oaDOI reports them. DOIs are still compared ignoring case")
+var maxBodyBytes = flag.Int64("max-body-bytes", oadoi.DefaultMaxBodyBytes, "Largest oaDOI response body, in bytes, to decode; larger ones are recorded as decode errors")
+var perPrefixLimit = flag.Int("per-prefix-limit", 0, "Most requests to run at a time for DOIs with the same registrant prefix, such as 10.1038 (0 for no limit beyond -httplimit)")
+var crossRef = flag.Bool("crossref", false, "Fill in the title, publisher and year of DOIs oaDOI has no record of from CrossRef")
+var headCheck = flag.Bool("head-check", false, "Check that the best OA URL of each DOI can be fetched, in the best_oa_url_status column; this doubles the requests made")
+var outputFile = flag.String("o", "", "File to write the report to instead of stdout")
+var compress = flag.Bool("compress", false, "Gzip the report; implied when the -o file name ends in .gz")
+var noClobber = flag.Bool("no-clobber", false, "Fail instead of truncating when the -o file already exists")
+var split = flag.Bool("split", false, "Write a report next to each input file, named after it, instead of one report to -o or stdout")
+var combineFile = flag.String("combine", "", "File to combine the -split reports of the input files into, as one report with one header, after processing them, or without looking anything up if -split isn't set; csv and tsv reports must have the same columns")
+var outputBuffer = flag.Int("output-buffer", 0, "Number of finished records that can wait to be written without holding up lookups; helps only when writing the report is as slow as looking up")
+var flushInterval = flag.Duration("flush-interval", 0, "How often to flush the report while it is written, so that rows are visible and kept if the run stops early; 0 flushes only at the end")
+var appendReport = flag.Bool("append", false, "Add to the end of the -o file instead of truncating it, leaving out the header if the file isn't empty")
+var inputFormat = flag.String("input-format", "ndjson", "Input format: ndjson (one publication per line) or array (a JSON array of publications)")
+var maxLine = flag.Int("max-line", oadoi.DefaultMaxLine, "Longest ndjson line, in bytes, to read; longer lines are skipped and counted as rejected")
+var outputFormat = flag.String("format", "csv", "Output format: csv, tsv, json (one JSON object per record), xlsx (needs -o) or flatjson (one JSON object per csv row, keyed by column)")
+var dedupe = flag.Bool("dedupe", false, "Look up each DOI once per run, reusing the response for later records with the same DOI")
+var allLocations = flag.Bool("all-locations", false, "Write a CSV row for every OA location of each DOI, not only the best one")
+var includeClosed = flag.Bool("include-closed", false, "With -all-locations, also write locations with no URL, and publisher copies with no licence (bronze)")
+var sherpaKey = flag.String("sherpa-key", "", "Sherpa Romeo v2 API key; if set, Sherpa links use the v2 API (and include the key) instead of the legacy pages")
+var sherpaURL = flag.String("sherpa-url", "", "Base URL of Sherpa links, instead of "+oadoi.SHERPAURI+", or "+oadoi.SHERPAV2URI+" with -sherpa-key")
+var columnList = flag.String("columns", "", "Comma separated keys of the CSV columns to write, in order (default all of them)")
+var issnOnly = flag.Bool("issn-only", false, "Write only the publication ID, journal ISSNs and Sherpa links, for auditing the links; the same as -columns "+strings.Join(issnColumns, ","))
+var fieldsFromPublication = flag.Bool("fields-from-publication", false, "Add the scheme and value of the publication identifier behind each API result to the columns chosen with -columns or -issn-only")
+var noHeader = flag.Bool("no-header", false, "Leave out the CSV header row, for concatenating reports")
+var skipOA = flag.Bool("skip-oa", false, "Only look up and report publications without an open access attachment in Artudis")
+var yearMin = flag.Int("year-min", 0, "Leave out DOIs that oaDOI dates before this year; filtered after the lookup, so it saves no quota")
+var yearMax = flag.Int("year-max", 0, "Leave out DOIs that oaDOI dates after this year; filtered after the lookup, so it saves no quota")
+var minDataStandard = flag.Int("min-data-standard", 0, "Leave out DOIs whose oaDOI record has a lower data_standard, such as 2 to drop legacy records; failed lookups and 404s are kept (0 keeps everything)")
+var includeUnknownYear = flag.Bool("include-unknown-year", false, "Keep DOIs with no year (including failed lookups) when -year-min or -year-max is set")
+var types stringList
+var lookupSchemes stringList
+var inputHeaders headerList
+var includes stringList
+var excludes stringList
+var sample = flag.Int("sample", 0, "Read only the first N publications of each input file, not counting blank or comment lines, for trying out options quickly (0 for all)")
+var printURLs = flag.String("print-urls", "", "File to write the oaDOI request URL of each DOI to, with the encoded email and any -doi-param, instead of requesting it; - for standard error")
+var dryRun = flag.Bool("dry-run", false, "Read and check the input and write the Artudis columns, without looking anything up")
+var weightsFlag = flag.String("weights", "", "Attachment type weights to merge over the defaults, as JSON or type:weight pairs, e.g. publishedVersion:4,correctedProof:3")
+var runReportFile = flag.String("report-file", "", "File to write a JSON report of the run to when it finishes, or is interrupted: input files, counts, errors, duration, flags and exit status")
+var deadLetter = flag.String("dead-letter", "", "File to write the original JSON of records whose lookup failed, for reprocessing")
+var errorFile = flag.String("error-file", "", "File to also write the rows of failed lookups (GET, decode or non-2xx) to, in the same format as the report")
+var onlyDOIFile = flag.String("only-doi-file", "", "File to write the DOIs that oaDOI found no open access copy of to, one per line, for re-submission")
+var webhookURL = flag.String("webhook-url", "", "URL to POST every record written to, as JSON arrays of records, with the retries, timeout and rate limit of oaDOI requests")
+var webhookBatchSize = flag.Int("webhook-batch-size", oadoi.DefaultWebhookBatchSize, "Most records to POST to -webhook-url at a time")
+var webhookErrors = flag.Bool("webhook-errors", false, "Also write records that couldn't be delivered to -webhook-url to -error-file")
+var rejectFile = flag.String("reject-file", "", "File to write input lines that are not valid JSON to, for fixing and reprocessing")
+var ordered = flag.Bool("ordered", false, "Write records in input order; records that finish early are held in memory until their turn")
+var sortFlag = flag.String("sort", "", "Sort the report by id, type, api_oa or year, adding :desc for descending order; holds each input in memory")
+var merge = flag.Bool("merge", false, "Merge all input files into a single report with each record ID appearing once")
+var mergePolicy = flag.String("merge-policy", "last", "Which copy of a duplicated record ID wins when merging: first or last")
+var perFileDeadline = flag.Duration("per-file-deadline", 0, "Maximum time to spend on a single input file before moving on to the next (0 for no limit)")
+var strict = flag.Bool("strict", false, "Abort at the first line that isn't a valid publication, publication with identifiers in an unrecognized shape, or lookup that errors (including with a 404)")
+var progressJSON = flag.String("progress-json", "", "File (or fd:N) to periodically write JSON progress objects to")
+var progressLog = flag.Bool("progress", stderrIsTerminal(), "Log progress every -progress-interval (the default when stderr is a terminal)")
+var progressInterval = flag.Duration("progress-interval", 5*time.Second, "How often to log progress and write to -progress-json")
+var metricsAddr = flag.String("metrics-addr", "", "Address, such as :9090, to serve Prometheus metrics on at /metrics while the run lasts")
+var primaryDOIOnly = flag.Bool("primary-doi-only", false, "Write one row per publication with several DOIs: the first open access one, or else the first")
+var aggregate = flag.Bool("aggregate", false, "Write one row per publication, combining all its DOIs: OA if any is, with the best OA version of them, and the number of DOIs checked in dois_checked")
+var countOnly = flag.Bool("count", false, "Look everything up but write no report, only printing the number of records, records with a DOI, OA DOIs, OA records in Artudis and mismatches")
+var baselineFile = flag.String("baseline", "", "Earlier csv or tsv report to compare with, marking each row new, changed (OA status flipped) or unchanged in the baseline_change column")
+var changesOnly = flag.Bool("changes-only", false, "With -baseline, write only the rows that are new or changed; the summary still counts every record")
+var onlyMismatches = flag.Bool("only-mismatches", false, "Write only the rows where Artudis and oaDOI disagree about open access; the summary still counts every record")
+var maxConsecutiveErrors = flag.Int("max-consecutive-errors", 0, "Stop, keeping the output so far, once this many lookups in a row have failed (0 for no limit)")
+var recoverPanics = flag.Bool("recover-panics", false, "Log and leave out a record whose processing panics, such as on a malformed response, instead of crashing; counted as an error")
+var failOnEmpty = flag.Bool("fail-on-empty", false, "Exit with status 3 if an input file has no records that can be read, which usually means a truncated or empty export")
+var maxErrors = flag.Int("max-errors", -1, "Exit with status 2 if more lookups than this fail, counting records left out by -recover-panics (-1 for no limit); the exit status is also 2 if every lookup fails")
+var logFormat = flag.String("log-format", "text", "Log format: text, or json for one JSON object per line")
+var logLevel = flag.String("log-level", "info", "Least severe log level to show: debug (every lookup), info, warn or error")
+var verbose = flag.Bool("verbose", false, "Same as -log-level debug")
+var quiet = flag.Bool("quiet", false, "Same as -log-level error")
+var skipWarmup = flag.Bool("skip-warmup", false, "Skip the startup request that checks the email and API connectivity. It is made by default, so that a rejected email or an outage stops a run before thousands of lookups fail; -dry-run, -print-urls and -snapshot without -api-fallback never make it")
+var commentPrefixes = flag.String("comment-prefixes", "//,#", "Comma separated prefixes of input lines to skip as comments, after any indentation; empty to read every line as a publication")
+var inputTimeout = flag.Duration("input-timeout", 0, "Time limit for fetching an input given as an http or https URL (0 for no limit)")
+
+func init() {
+	flag.Var(&types, "type", "Publication type to look up and report, ignoring case; may be repeated or comma separated (default all types)")
+	flag.Var(&lookupSchemes, "lookup-schemes", "Identifier schemes whose values to look up in oaDOI, ignoring case; may be repeated or comma separated (default doi)")
+	flag.Var(&includes, "include", "Glob of input files to process when none are named, relative to the working directory; may be repeated or comma separated (default "+strings.Join(defaultIncludes, ",")+")")
+	flag.Var(&excludes, "exclude", "Glob of input files to leave out, matched against the name as given or its base name, e.g. *.tmp; may be repeated or comma separated")
+	flag.Var(&inputHeaders, "input-header", "Header to send when fetching an input given as an http or https URL, as \"Name: value\"; may be repeated")
 }
 
-type APIResponse struct {
-	HTTPStatus string
-	APIResponseBody
-	JSONDecodeError string
-	GETError        string
+// stringList is a flag that can be repeated, with each value a comma
+// separated list.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
 }
 
-type APIResponseBody struct {
-	BestOaLocation struct {
-		Evidence          string `json:"evidence"`
-		HostType          string `json:"host_type"`
-		ID                string `json:"id"`
-		URL               string `json:"url"`
-		URLForLandingPage string `json:"url_for_landing_page"`
-		URLForPdf         string `json:"url_for_pdf"`
-		Version           string `json:"version"`
-	} `json:"best_oa_location"`
-	DataStandard int    `json:"data_standard"`
-	Doi          string `json:"doi"`
-	DoiURL       string `json:"doi_url"`
-	IsOa         bool   `json:"is_oa"`
-	JournalIsOa  bool   `json:"journal_is_oa"`
-	JournalIssns string `json:"journal_issns"`
-	JournalName  string `json:"journal_name"`
-	Publisher    string `json:"publisher"`
-	Title        string `json:"title"`
-	Updated      string `json:"updated"`
-	Year         int    `json:"year"`
+func (list *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
 }
 
-const OADOIURL string = "https://api.oadoi.org/v2/"
-const SHERPAURI string = "http://www.sherpa.ac.uk/romeo/issn/"
+// headerList is a flag of HTTP headers, each given as "Name: value". It can
+// be repeated; values aren't split on commas, which headers may contain.
+type headerList []string
 
-var attachmentTypeToWeightMap = map[string]int{
-	"missing":             0,
-	"other":               1,
-	"submittedManuscript": 2,
-	"acceptedManuscript":  3,
-	"finalVersion":        4,
+func (list *headerList) String() string {
+	return strings.Join(*list, ", ")
 }
 
-var email = flag.String("email", "", "Email to pass to the oaDOI API")
-var httplimit = flag.Int("httplimit", 5, "Number of HTTP requests that can run concurrently")
+func (list *headerList) Set(value string) error {
+	name, _, found := strings.Cut(value, ":")
+	if !found || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header %q is not of the form \"Name: value\"", value)
+	}
+	*list = append(*list, value)
+	return nil
+}
+
+// defaultIncludes are the -include patterns used if none are given.
+var defaultIncludes = []string{"*Publication-export.json", "*Publication-export.json.gz"}
 
 func findFilesToProcess() []string {
+	workingDir, err := os.Getwd()
+	if err != nil {
+		fatal("Error getting working directory.", "error", err)
+	}
 	if len(flag.Args()) == 0 {
-		log.Println("No file names provided, trying to find files ending with Publication-export.json in current working directory.")
-		workingDir, err := os.Getwd()
-		if err != nil {
-			log.Fatalln("Error getting working directory. ", err)
+		patterns := includes
+		if len(patterns) == 0 {
+			patterns = defaultIncludes
 		}
-		matches, err := filepath.Glob(filepath.Join(workingDir, "*Publication-export.json"))
-		if err != nil {
-			log.Fatalln("Error finding matching files. ", err)
+		slog.Info("No file names provided, trying to find files matching -include in current working directory.", "include", strings.Join(patterns, ","))
+	}
+	files, err := resolveFiles(workingDir, flag.Args(), includes, excludes)
+	if err != nil {
+		fatal("Error finding matching files.", "error", err)
+	}
+	// Input URLs may carry a token, which is kept out of the log.
+	names := make([]string, len(files))
+	for i, fileName := range files {
+		names[i] = redactURL(fileName)
+	}
+	slog.Info("Resolved files to process", "files", len(files), "names", strings.Join(names, ","))
+	return files
+}
+
+// resolveFiles returns the files named in args, or if there are none, the
+// files in dir matching any of the include patterns (defaultIncludes if
+// there are none), sorted and without duplicates. Files whose name, or base
+// name, matches any of the exclude patterns are left out either way.
+func resolveFiles(dir string, args []string, include []string, exclude []string) ([]string, error) {
+	for _, pattern := range exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("-exclude %q: %v", pattern, err)
 		}
-		return matches
-	} else {
-		return flag.Args()
 	}
+
+	candidates := args
+	if len(args) == 0 {
+		if len(include) == 0 {
+			include = defaultIncludes
+		}
+		seen := map[string]bool{}
+		candidates = nil
+		for _, pattern := range include {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(dir, pattern)
+			}
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("-include %q: %v", pattern, err)
+			}
+			for _, match := range matches {
+				if !seen[match] {
+					seen[match] = true
+					candidates = append(candidates, match)
+				}
+			}
+		}
+		sort.Strings(candidates)
+	}
+
+	var files []string
+	for _, name := range candidates {
+		if !excluded(name, exclude) {
+			files = append(files, name)
+		}
+	}
+	return files, nil
 }
 
-func processFile(fileName string) {
-	file, err := os.Open(fileName)
+func excluded(name string, exclude []string) bool {
+	for _, pattern := range exclude {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, filepath.Base(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func processFile(ctx context.Context, processor *oadoi.Processor, fileName string, w io.Writer) {
+	file, err := openInput(fileName)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Error opening input.", "file", redactURL(fileName), "error", err)
 		return
 	}
 	defer file.Close()
 
-	output := make(chan Record)
+	ctx, cancel := withFileDeadline(ctx)
+	defer cancel()
+
+	start := time.Now()
+	before := processor.Total()
+	requestsBefore := processor.Client.Requests()
 
-	ticketToHTTP := make(chan bool, *httplimit)
-	for i := 0; i < *httplimit; i++ {
-		ticketToHTTP <- true
+	err = processor.ProcessReader(ctx, sourceName(fileName), file, w)
+	if err != nil {
+		fatal("Error processing file.", "file", redactURL(fileName), "error", err)
 	}
 
-	var waitgroupLines sync.WaitGroup
-	fileScanner := bufio.NewScanner(file)
-	buf := make([]byte, 0, 1024*1024)
-	fileScanner.Buffer(buf, 1024*1024*32)
-	for fileScanner.Scan() {
-		waitgroupLines.Add(1)
-		publicationBytes := append([]byte{}, fileScanner.Bytes()...)
-		go processPublication(publicationBytes, &waitgroupLines, ticketToHTTP, output)
+	if ctx.Err() == context.DeadlineExceeded {
+		slog.Warn("Per-file deadline exceeded, output flushed, moving on to the next file.", "file", redactURL(fileName))
 	}
 
-	err = fileScanner.Err()
-	if err != nil {
-		log.Fatalln(err)
+	after := processor.Total()
+	elapsed := time.Since(start)
+	requests := processor.Client.Requests() - requestsBefore
+	slog.Info("Processed file", "file", redactURL(fileName), "elapsed", elapsed.Round(time.Millisecond),
+		"records", after.Records-before.Records, "requests", requests,
+		"requests_per_second", fmt.Sprintf("%.2f", float64(requests)/elapsed.Seconds()))
+
+	if ctx.Err() == nil {
+		checkEmptyInput(fileName, after.ParsedRecords-before.ParsedRecords)
 	}
+}
+
+// emptyInputs counts the inputs that checkEmptyInput found had no records.
+var emptyInputs int
 
-	var waitgroupOutput sync.WaitGroup
-	waitgroupOutput.Add(1)
-	go processOutput(output, &waitgroupOutput)
+// checkEmptyInput logs an input that had no records in it, which is
+// usually a broken export, and with -fail-on-empty counts it, so that the
+// run exits with status 3.
+func checkEmptyInput(fileName string, records int) {
+	if records > 0 {
+		return
+	}
+	if !*failOnEmpty {
+		slog.Warn("No records in input.", "file", redactURL(fileName))
+		return
+	}
+	slog.Error("No records in input, the export may be truncated or empty.", "file", redactURL(fileName))
+	emptyInputs++
+}
 
-	waitgroupLines.Wait()
-	close(output)
-	close(ticketToHTTP)
-	waitgroupOutput.Wait()
+// processSplitFile processes a file into its own report, named by
+// splitReportName.
+func processSplitFile(ctx context.Context, processor *oadoi.Processor, fileName string) {
+	if fileName == stdinName || isURL(fileName) {
+		fatal("-split can't name a report for standard input or a URL.", "file", redactURL(fileName))
+	}
 
+	reportName := splitReportName(fileName, *outputFormat, *compress)
+	report, err := openReport(reportName, *noClobber, *appendReport, *compress)
+	if err != nil {
+		fatal("Error creating output file.", "file", reportName, "error", err)
+	}
+	closeReport := func() {
+		err := report.Close()
+		if err != nil {
+			slog.Error("Error closing output file.", "file", reportName, "error", err)
+		}
+	}
+	defer closeReport()
+	atFatal = append(atFatal, closeReport)
+
+	processor.WriterOptions.NoHeader = *noHeader || report.appended
+	slog.Info("Writing report", "file", reportName)
+	processFile(ctx, processor, fileName, report)
 }
 
-func processOutput(output <-chan Record, waitgroupOutput *sync.WaitGroup) {
-	defer waitgroupOutput.Done()
-
-	w := csv.NewWriter(os.Stdout)
-
-	header := []string{
-		"Artudis - ID",
-		"Artudis - Publication Type",
-		"Artudis - Available OA",
-		"Artudis - Best Type OA",
-		"API - Available OA",
-		"API - Best OA Location Version",
-		"API - DOI",
-		"API - Best OA Location URL",
-		"API - Title",
-		"API - HTTP Response Status",
-		"API - JSON Decode Error",
-		"API - GET Error",
-		"API - Sherpa Link",
-	}
-
-	err := w.Write(header)
-
-	for record := range output {
-
-		artudisOA := false
-		highestLevel := "missing"
-		for _, attachment := range record.Attachment {
-			if attachment.OpenAccess == "true" {
-				artudisOA = true
-				if attachmentTypeToWeightMap[attachment.Type] > attachmentTypeToWeightMap[highestLevel] {
-					highestLevel = attachment.Type
-				}
-			}
+func withFileDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *perFileDeadline > 0 {
+		return context.WithTimeout(ctx, *perFileDeadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+func processMergedFiles(ctx context.Context, processor *oadoi.Processor, fileNames []string, w io.Writer) {
+	var lines []oadoi.Line
+	lineIndexByID := map[string]int{}
+	duplicates := 0
+
+	for _, fileName := range fileNames {
+		if ctx.Err() != nil {
+			return
 		}
 
-		for _, apiresponse := range record.APIResponses {
-			toCSVOutput := []string{
-				record.Publication.ID,
-				record.Publication.Type,
-				strconv.FormatBool(artudisOA),
-				highestLevel,
-				strconv.FormatBool(apiresponse.APIResponseBody.IsOa),
-				apiresponse.APIResponseBody.BestOaLocation.Version,
-				apiresponse.APIResponseBody.Doi,
-				apiresponse.APIResponseBody.BestOaLocation.URL,
-				apiresponse.APIResponseBody.Title,
-				apiresponse.HTTPStatus,
-				apiresponse.JSONDecodeError,
-				apiresponse.GETError,
-				makeSherpaLink(apiresponse.JournalIssns),
+		slog.Info("Reading", "file", redactURL(fileName))
+		file, err := openInput(fileName)
+		if err != nil {
+			slog.Error("Error opening input.", "file", redactURL(fileName), "error", err)
+			continue
+		}
+
+		lineReader, err := oadoi.NewLineReader(*inputFormat, sourceName(fileName), file, *maxLine)
+		if err != nil {
+			fatal("Error reading input.", "file", redactURL(fileName), "error", err)
+		}
+		records := 0
+		for line, ok := lineReader.Next(); ok; line, ok = lineReader.Next() {
+			var publication struct {
+				ID string `json:"__id__"`
+			}
+			err := json.Unmarshal(line.Bytes, &publication)
+			if err == nil {
+				records++
+			}
+			if err != nil || publication.ID == "" {
+				lines = append(lines, line)
+				continue
 			}
 
-			err := w.Write(toCSVOutput)
+			index, seen := lineIndexByID[publication.ID]
+			if !seen {
+				lineIndexByID[publication.ID] = len(lines)
+				lines = append(lines, line)
+				continue
+			}
 
-			if err != nil {
-				log.Println("error writing record to csv:", err)
-				return
+			duplicates++
+			if *mergePolicy == "last" {
+				lines[index] = line
 			}
 		}
+
+		err = lineReader.Err()
+		file.Close()
+		if err != nil {
+			fatal("Error reading input.", "file", redactURL(fileName), "error", err)
+		}
+		checkEmptyInput(fileName, records)
+	}
+
+	slog.Info(fmt.Sprintf("Merged %d records from %d files, %d duplicates collapsed", len(lines), len(fileNames), duplicates))
+
+	if processor.Progress != nil {
+		var totalBytes int64
+		for _, line := range lines {
+			totalBytes += int64(len(line.Bytes) + 1)
+		}
+		processor.Progress.TotalBytes.Store(totalBytes)
 	}
 
-	w.Flush()
+	ctx, cancel := withFileDeadline(ctx)
+	defer cancel()
 
-	err = w.Error()
+	err := processor.ProcessLines(ctx, lines, w)
 	if err != nil {
-		log.Println("error writing record to csv:", err)
-		return
+		fatal("Error processing the merged files.", "error", err)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		slog.Warn("Per-file deadline exceeded for the merged files, output flushed.")
 	}
 }
 
-func processPublication(publicationBytes []byte, waitgroupLines *sync.WaitGroup, ticketToHTTP chan bool, output chan<- Record) {
-	defer waitgroupLines.Done()
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
 
-	var record Record
+// validateAPIURL checks an -api-url: an absolute http(s) URL, which the DOI
+// is added to the end of, unless it is passed in a query parameter.
+func validateAPIURL(rawURL string, doiParam bool) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", rawURL)
+	}
+	if !doiParam && (!strings.HasSuffix(parsed.Path, "/") || parsed.RawQuery != "") {
+		return fmt.Errorf("%q must end with a trailing slash", rawURL)
+	}
+	return nil
+}
 
-	err := json.Unmarshal(publicationBytes, &record.Publication)
+// validateSherpaURL checks a -sherpa-url: an absolute http(s) URL without a
+// query. The base of legacy links, which have ISSNs appended as a path,
+// must end with a slash.
+func validateSherpaURL(rawURL string, v2 bool) error {
+	parsed, err := url.Parse(rawURL)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", rawURL)
+	}
+	if parsed.RawQuery != "" {
+		return fmt.Errorf("%q must not have a query", rawURL)
+	}
+	if !v2 && !strings.HasSuffix(parsed.Path, "/") {
+		return fmt.Errorf("%q must end with a trailing slash", rawURL)
+	}
+	return nil
+}
+
+// validateWebhookURL checks a -webhook-url: an absolute http(s) URL.
+func validateWebhookURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", rawURL)
+	}
+	return nil
+}
+
+// parseWeights parses the -weights flag: either a JSON object of attachment
+// type to weight, or comma separated type:weight pairs.
+func parseWeights(value string) (map[string]int, error) {
+	weights := map[string]int{}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return weights, nil
+	}
+
+	if strings.HasPrefix(value, "{") {
+		err := json.Unmarshal([]byte(value), &weights)
+		return weights, err
 	}
 
-	for _, identifier := range record.Publication.Identifier {
-		if identifier.Scheme == "doi" {
-			record.APIResponses = append(record.APIResponses, doAPIRequest(identifier.Value, ticketToHTTP))
+	for _, pair := range strings.Split(value, ",") {
+		attachmentType, weight, found := strings.Cut(pair, ":")
+		if !found {
+			return nil, fmt.Errorf("%q is not type:weight", pair)
 		}
+		number, err := strconv.Atoi(strings.TrimSpace(weight))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not type:weight", pair)
+		}
+		weights[strings.TrimSpace(attachmentType)] = number
+	}
+	return weights, nil
+}
+
+// setupLogging sends logs of at least level to stderr as text, through the
+// log package as before, or as JSON objects with the level, message and
+// fields such as file, line and doi.
+func setupLogging(format string, level string) error {
+	var minimum slog.Level
+	err := minimum.UnmarshalText([]byte(level))
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+		slog.SetLogLoggerLevel(minimum)
+		return nil
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: minimum})))
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// atFatal are run by fatal before exiting, most recent first, since deferred
+// functions are not.
+var atFatal []func()
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	for i := len(atFatal) - 1; i >= 0; i-- {
+		atFatal[i]()
+	}
+	os.Exit(1)
+}
+
+// resolveEmail returns the -email flag value, falling back to the
+// OADOI_EMAIL environment variable.
+func resolveEmail(flagValue string, getenv func(string) string) string {
+	if flagValue = strings.TrimSpace(flagValue); flagValue != "" {
+		return flagValue
+	}
+	return strings.TrimSpace(getenv("OADOI_EMAIL"))
+}
+
+// validateEmail checks that email is a bare address, without a display
+// name, since oaDOI is given it as is.
+func validateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return fmt.Errorf("%q is not an email address: %v", email, err)
 	}
+	if address.Name != "" || address.Address != email {
+		return fmt.Errorf("%q must be a bare address such as someone@example.com", email)
+	}
+	return nil
+}
 
-	output <- record
+func main() {
+	os.Exit(run())
 }
 
-func doAPIRequest(doi string, ticketToHTTP chan bool) APIResponse {
-	defer func() { ticketToHTTP <- true }()
+func run() int {
+	startedAt := time.Now()
+	flag.Parse()
 
-	// Wait for ticket
-	<-ticketToHTTP
+	if *configFile != "" {
+		err := loadConfig(flag.CommandLine, *configFile)
+		if err != nil {
+			fatal("Error reading config file.", "error", err)
+		}
+	}
 
-	var apiResponse APIResponse
+	if *showVersion {
+		fmt.Printf("artudis-oadoi-report %s (commit %s, built %s)\n", version, commit, date)
+		return 0
+	}
 
-	url := OADOIURL + strings.TrimPrefix(doi, "http://dx.doi.org/") + "?email=" + *email
-	resp, err := http.Get(url)
+	level := *logLevel
+	if *verbose {
+		level = "debug"
+	}
+	if *quiet {
+		level = "error"
+	}
+	err := setupLogging(*logFormat, level)
 	if err != nil {
-		apiResponse.GETError = err.Error()
-		return apiResponse
+		fatal("Invalid logging options.", "error", err)
 	}
 
-	defer resp.Body.Close()
+	// Without a fallback, a snapshot run makes no API requests.
+	// So does combining -split reports without making them.
+	offline := *dryRun || (*snapshotFile != "" && !*apiFallback) || (*combineFile != "" && !*split)
 
-	apiResponse.HTTPStatus = resp.Status
+	*email = resolveEmail(*email, os.Getenv)
+	if *email == "" && !offline {
+		fatal("An email is required, either with -email or OADOI_EMAIL.")
+	}
+	if *email != "" {
+		err := validateEmail(*email)
+		if err != nil {
+			fatal("Invalid email.", "error", err)
+		}
+	}
+
+	if *httplimit < 1 || *requestTimeout <= 0 {
+		fatal("-httplimit and -timeout must be positive.")
+	}
+
+	if *rps < 0 {
+		fatal("-rps must not be negative.")
+	}
+
+	if *workersTotal < 0 {
+		fatal("-workers-total must not be negative.")
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&apiResponse.APIResponseBody)
+	if *concurrencyAuto && (*concurrencyMin < 1 || *concurrencyMin > *httplimit) {
+		fatal("-concurrency-min must be between 1 and -httplimit.")
+	}
+
+	err = validateAPIURL(*apiURL, *doiParam != "")
 	if err != nil {
-		apiResponse.JSONDecodeError = err.Error()
-		return apiResponse
+		fatal("Invalid -api-url.", "error", err)
 	}
 
-	return apiResponse
-}
+	if *sherpaURL != "" {
+		err = validateSherpaURL(*sherpaURL, *sherpaKey != "")
+		if err != nil {
+			fatal("Invalid -sherpa-url.", "error", err)
+		}
+	}
+
+	if *webhookURL != "" {
+		err = validateWebhookURL(*webhookURL)
+		if err != nil {
+			fatal("Invalid -webhook-url.", "error", err)
+		}
+		if *webhookBatchSize < 1 {
+			fatal("-webhook-batch-size must be positive.")
+		}
+	}
+	if *webhookErrors && (*webhookURL == "" || *errorFile == "") {
+		fatal("-webhook-errors needs -webhook-url and -error-file.")
+	}
+
+	if *cacheDir != "" {
+		err := os.MkdirAll(*cacheDir, 0755)
+		if err != nil {
+			fatal("Error creating cache directory.", "error", err)
+		}
+	}
+
+	if *rawDir != "" {
+		err := os.MkdirAll(*rawDir, 0755)
+		if err != nil {
+			fatal("Error creating -raw-dir directory.", "error", err)
+		}
+	}
 
-func makeSherpaLink(issns string) string {
-	if issns == "" {
-		return ""
+	if !stringInSlice(*inputFormat, oadoi.InputFormats) {
+		fatal("-input-format must be one of " + strings.Join(oadoi.InputFormats, ", "))
 	}
 
-	sherpaLinks := []string{}
+	if !stringInSlice(*outputFormat, oadoi.OutputFormats) {
+		fatal("-format must be one of " + strings.Join(oadoi.OutputFormats, ", "))
+	}
 
-	issnsSplit := strings.Split(issns, ",")
-	for _, issn := range(issnsSplit) {
-		if issn != "" {
-			if string(issn[4]) == "-" && len(issn) == 9 {
-				sherpaLinks = append(sherpaLinks, SHERPAURI + issn + "/")
-			} else if len(issn) == 8 {
-				repaired := issn[0:4] + "-" + issn[4:8]
-				sherpaLinks = append(sherpaLinks, SHERPAURI + repaired + "/")
+	var columns []string
+	if *issnOnly {
+		if *columnList != "" {
+			fatal("-issn-only and -columns can't be used together.")
+		}
+		columns = issnColumns
+	}
+	if *columnList != "" {
+		for _, column := range strings.Split(*columnList, ",") {
+			column = strings.TrimSpace(column)
+			if !stringInSlice(column, oadoi.ColumnKeys()) {
+				fatal("Unknown column " + column + ". Valid columns are " + strings.Join(oadoi.ColumnKeys(), ", "))
+			}
+			columns = append(columns, column)
+		}
+	}
+	if *fieldsFromPublication && len(columns) > 0 {
+		for _, column := range identifierColumns {
+			if !stringInSlice(column, columns) {
+				columns = append(columns, column)
 			}
 		}
 	}
 
-	return strings.Join(sherpaLinks, ",")
-}
+	weights, err := parseWeights(*weightsFlag)
+	if err != nil {
+		fatal("Invalid -weights.", "error", err)
+	}
 
-func main() {
-	flag.Parse()
+	if *split && (*outputFile != "" || *merge || *countOnly) {
+		fatal("-split can't be used with -o, -merge or -count.")
+	}
+
+	if *combineFile != "" {
+		if *outputFile != "" || *merge || *countOnly || *appendReport {
+			fatal("-combine can't be used with -o, -merge, -count or -append.")
+		}
+		if *outputFormat == "xlsx" {
+			fatal("-combine can't be used with -format xlsx.")
+		}
+		if !*split {
+			err := combineSplitReports(findFilesToProcess())
+			if err != nil {
+				fatal("Error combining reports.", "error", err)
+			}
+			return 0
+		}
+	}
+
+	// An xlsx workbook is only readable once finished, so there can only be
+	// one, in a file.
+	if *outputFormat == "xlsx" && ((*outputFile == "" && !*split) || *appendReport) {
+		fatal("-format xlsx needs an -o file or -split, and can't be used with -append.")
+	}
+
+	if *changesOnly && *baselineFile == "" {
+		fatal("-changes-only needs -baseline.")
+	}
+
+	if *outputBuffer < 0 {
+		fatal("-output-buffer must not be negative.")
+	}
+
+	if *flushInterval > 0 && *outputFormat == "xlsx" {
+		fatal("-flush-interval can't be used with -format xlsx.")
+	}
+
+	if *appendReport && (*noClobber || (*outputFile == "" && !*split)) {
+		fatal("-append needs an -o file or -split, and can't be used with -no-clobber.")
+	}
 
-	if *email == "" {
-		log.Fatal("FATAL: An email is required.")
+	if *aggregate && *primaryDOIOnly {
+		fatal("-aggregate and -primary-doi-only can't be used together.")
+	}
+
+	var sortOrder oadoi.SortOrder
+	if *sortFlag != "" {
+		if *ordered {
+			fatal("-sort and -ordered can't be used together.")
+		}
+		sortOrder, err = oadoi.ParseSortOrder(*sortFlag)
+		if err != nil {
+			fatal("Invalid -sort.", "error", err)
+		}
+	}
+
+	if *mergePolicy != "first" && *mergePolicy != "last" {
+		fatal("-merge-policy must be first or last.")
+	}
+
+	client := oadoi.NewClient(*email, *httplimit)
+	client.BaseURL = *apiURL
+	client.DOIParam = *doiParam
+	client.Timeout = *requestTimeout
+	client.Retries = *retries
+	client.MaxRetryWait = *maxRetryWait
+	client.CacheDir = *cacheDir
+	client.RawDir = *rawDir
+	client.CacheTTL = *cacheTTL
+	client.RequestsPerSecond = *rps
+	client.CrossRef = *crossRef
+	client.HeadCheck = *headCheck
+	client.MaxRequests = *maxRequests
+	client.PerPrefixLimit = *perPrefixLimit
+	client.AutoConcurrency = *concurrencyAuto
+	client.MinConcurrency = *concurrencyMin
+	client.MaxBodyBytes = *maxBodyBytes
+	client.PreserveDOICase = *preserveDOICase
+
+	tlsConfig, err := oadoi.LoadTLSConfig(*caFile, *insecureSkipVerify)
+	if err != nil {
+		fatal("Invalid -ca-file.", "error", err)
+	}
+	if tlsConfig != nil {
+		if *insecureSkipVerify {
+			slog.Warn("Not verifying TLS certificates, because of -insecure-skip-verify.")
+		}
+		err := client.SetTLSConfig(tlsConfig)
+		if err != nil {
+			fatal("Error configuring TLS.", "error", err)
+		}
+	}
+	if *snapshotFile != "" {
+		slog.Info("Indexing snapshot.", "file", *snapshotFile)
+		snapshot, err := oadoi.OpenSnapshot(*snapshotFile)
+		if err != nil {
+			fatal("Error opening snapshot.", "error", err)
+		}
+		defer snapshot.Close()
+		slog.Info("Indexed snapshot.", "dois", snapshot.Len())
+		client.Snapshot = snapshot
+		client.APIFallback = *apiFallback
+	}
+	client.UserAgent = *userAgentOverride
+	if client.UserAgent == "" {
+		client.UserAgent = "artudis-oadoi-report/" + version + " (mailto:" + *email + ")"
+	}
+
+	var prefixes stringList
+	prefixes.Set(*commentPrefixes)
+
+	processor := &oadoi.Processor{
+		Client:      client,
+		InputFormat: *inputFormat,
+		MaxLine:     *maxLine,
+		Format:      *outputFormat,
+		WriterOptions: oadoi.WriterOptions{
+			AllLocations:      *allLocations,
+			IncludeClosed:     *includeClosed,
+			SherpaKey:         *sherpaKey,
+			SherpaURL:         *sherpaURL,
+			Columns:           columns,
+			NoHeader:          *noHeader,
+			AttachmentWeights: oadoi.AttachmentWeights(weights),
+			PreserveDOICase:   *preserveDOICase,
+		},
+		Workers: *workersTotal,
+		Ordered: *ordered,
+		Sort:    sortOrder,
+		Strict:  *strict,
+		Dedupe:  *dedupe,
+		DryRun:  *dryRun,
+		Sample:  *sample,
+		SkipOA:  *skipOA,
+		Types:   types,
+
+		MaxConsecutiveErrors: *maxConsecutiveErrors,
+		RecoverPanics:        *recoverPanics,
+		CountOnly:            *countOnly,
+		OnlyMismatches:       *onlyMismatches,
+		ChangesOnly:          *changesOnly,
+		FlushInterval:        *flushInterval,
+		OutputBuffer:         *outputBuffer,
+		PrimaryDOIOnly:       *primaryDOIOnly,
+		Aggregate:            *aggregate,
+		LookupSchemes:        lookupSchemes,
+		CommentPrefixes:      prefixes,
+
+		YearMin:            *yearMin,
+		YearMax:            *yearMax,
+		IncludeUnknownYear: *includeUnknownYear,
+		MinDataStandard:    *minDataStandard,
+
+		WebhookURL:       *webhookURL,
+		WebhookBatchSize: *webhookBatchSize,
+		WebhookErrors:    *webhookErrors,
+	}
+	if processor.Workers == 0 {
+		processor.Workers = workersPerRequest * *httplimit
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The run report is written however the run ends, short of being
+	// killed: fatal errors, such as from -strict, write it with status 1.
+	var filesToProcess []string
+	finish := func(exitStatus int) int {
+		if *runReportFile == "" {
+			return exitStatus
+		}
+		details := newRunReport(startedAt, time.Now(), filesToProcess, processor.Total(), client.Requests(),
+			ctx.Err() != nil, exitStatus, flag.CommandLine)
+		err := writeRunReport(*runReportFile, details)
+		if err != nil {
+			slog.Error("Error writing run report.", "file", *runReportFile, "error", err)
+		}
+		return exitStatus
+	}
+	atFatal = append(atFatal, func() { finish(1) })
+
+	for _, scheme := range lookupSchemes {
+		if !stringInSlice(strings.ToLower(scheme), oadoi.KnownSchemes) {
+			slog.Warn("Unknown identifier scheme in -lookup-schemes, its values will still be looked up in oaDOI.", "scheme", scheme, "known", strings.Join(oadoi.KnownSchemes, ","))
+		}
+	}
+
+	// The baseline is read before the report is opened, which may replace
+	// it.
+	if *baselineFile != "" {
+		baseline, err := oadoi.OpenBaseline(*baselineFile)
+		if err != nil {
+			fatal("Error reading baseline.", "error", err)
+		}
+		slog.Info("Read baseline.", "file", *baselineFile, "rows", baseline.Len())
+		processor.WriterOptions.Baseline = baseline
 	}
 
-	filesToProcess := findFilesToProcess()
+	if !*skipWarmup && !offline && *printURLs == "" {
+		err := client.Warmup(context.Background())
+		if err != nil {
+			fatal("Warmup request failed.", "error", err)
+		}
+	}
+
+	var report io.Writer = io.Discard
+	if !*countOnly && !*split {
+		reportFile, err := openReport(*outputFile, *noClobber, *appendReport, *compress)
+		if err != nil {
+			fatal("Error creating output file.", "error", err)
+		}
+		if reportFile.appended {
+			processor.WriterOptions.NoHeader = true
+		}
+		closeReport := func() {
+			err := reportFile.Close()
+			if err != nil {
+				slog.Error("Error closing output file.", "error", err)
+			}
+		}
+		defer closeReport()
+		atFatal = append(atFatal, closeReport)
+		report = reportFile
+	}
+
+	if *resumeLedger != "" {
+		ledger, err := oadoi.OpenLedger(*resumeLedger)
+		if err != nil {
+			fatal("Error opening resume ledger.", "error", err)
+		}
+		defer ledger.Close()
+		slog.Info("Resuming from ledger.", "file", *resumeLedger, "dois", ledger.Len())
+		processor.Ledger = ledger
+	}
+
+	if *deadLetter != "" {
+		deadLetterFile, err := os.Create(*deadLetter)
+		if err != nil {
+			fatal("Error creating dead letter file.", "error", err)
+		}
+		defer deadLetterFile.Close()
+		processor.DeadLetter = deadLetterFile
+	}
+
+	if *errorFile != "" {
+		errors, err := os.Create(*errorFile)
+		if err != nil {
+			fatal("Error creating error file.", "error", err)
+		}
+		defer errors.Close()
+		processor.Errors = errors
+	}
+
+	if *rejectFile != "" {
+		rejects, err := os.Create(*rejectFile)
+		if err != nil {
+			fatal("Error creating reject file.", "error", err)
+		}
+		defer rejects.Close()
+		processor.Rejects = rejects
+	}
+
+	if *onlyDOIFile != "" {
+		notOADOIs, err := os.Create(*onlyDOIFile)
+		if err != nil {
+			fatal("Error creating -only-doi-file.", "error", err)
+		}
+		defer notOADOIs.Close()
+		processor.NotOADOIs = notOADOIs
+	}
+
+	if *printURLs == "-" {
+		processor.PrintURLs = os.Stderr
+	} else if *printURLs != "" {
+		urls, err := os.Create(*printURLs)
+		if err != nil {
+			fatal("Error creating -print-urls file.", "error", err)
+		}
+		defer urls.Close()
+		processor.PrintURLs = urls
+	}
+
+	filesToProcess = findFilesToProcess()
 	if len(filesToProcess) == 0 {
-		log.Fatalln("Could not find any files to process.")
+		fatal("Could not find any files to process.")
+	}
+	if *outputFormat == "xlsx" && len(filesToProcess) > 1 && !*merge && !*split {
+		fatal("-format xlsx with several input files needs -merge, to write them as one workbook.")
+	}
+
+	if (*progressJSON != "" || *progressLog) && *progressInterval <= 0 {
+		fatal("-progress-interval must be positive.")
+	}
+
+	if *progressJSON != "" || *progressLog || *metricsAddr != "" {
+		processor.Progress = &oadoi.Progress{}
+		for _, fileName := range filesToProcess {
+			size, err := inputSize(fileName)
+			if err == nil {
+				processor.Progress.TotalBytes.Add(size)
+			}
+		}
+	}
+
+	if *progressJSON != "" {
+		progressWriter, err := openProgressJSON(*progressJSON)
+		if err != nil {
+			fatal("Error opening progress output.", "error", err)
+		}
+		defer progressWriter.Close()
+
+		stopProgress := startProgressJSON(processor.Progress, progressWriter, *progressInterval)
+		defer stopProgress()
+	}
+
+	if *progressLog {
+		stopProgress := startProgressLog(processor.Progress, *progressInterval)
+		defer stopProgress()
+	}
+
+	if *metricsAddr != "" {
+		metrics := &oadoi.Metrics{Progress: processor.Progress}
+		client.Metrics = metrics
+		stopMetrics, err := startMetricsServer(*metricsAddr, metrics)
+		if err != nil {
+			fatal("Error starting metrics server.", "error", err)
+		}
+		defer stopMetrics()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		// Let a second signal kill the process as normal.
+		signal.Stop(signals)
+		slog.Warn("Stopping: no new lookups will be started, records already looked up will be written out.")
+		cancel()
+	}()
+
+	if *merge {
+		processMergedFiles(ctx, processor, filesToProcess, report)
+	} else {
+		for _, fileName := range filesToProcess {
+			if ctx.Err() != nil {
+				break
+			}
+			slog.Info("Processing", "file", redactURL(fileName))
+			if *split {
+				processSplitFile(ctx, processor, fileName)
+			} else {
+				processFile(ctx, processor, fileName, report)
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		slog.Error("Interrupted, output is incomplete.")
+		return finish(1)
+	}
+
+	if *combineFile != "" {
+		err := combineSplitReports(filesToProcess)
+		if err != nil {
+			fatal("Error combining reports.", "error", err)
+		}
+	}
+
+	if *countOnly {
+		writeCounts(os.Stdout, processor.Total())
+	}
+
+	if quotaExceeded := processor.Total().QuotaExceeded; quotaExceeded > 0 {
+		slog.Warn(fmt.Sprintf("%d DOIs were not looked up because -max-requests %d was reached.", quotaExceeded, *maxRequests))
+	}
+
+	exitStatus := lookupExitCode(processor.Total(), *maxErrors)
+	if exitStatus == 0 && emptyInputs > 0 {
+		slog.Error(fmt.Sprintf("%d input files had no records, and -fail-on-empty is set.", emptyInputs))
+		exitStatus = 3
+	}
+	return finish(exitStatus)
+}
+
+// writeCounts writes the -count figures, one per line.
+func writeCounts(w io.Writer, total oadoi.Summary) {
+	fmt.Fprintf(w, "Records: %d\n", total.Records)
+	fmt.Fprintf(w, "Records with a DOI: %d\n", total.RecordsWithDOI)
+	fmt.Fprintf(w, "OA in oaDOI: %d\n", total.APIOATrue)
+	fmt.Fprintf(w, "OA in Artudis: %d\n", total.ArtudisOATrue)
+	fmt.Fprintf(w, "OA mismatches: %d\n", total.OAMismatches)
+}
+
+// lookupExitCode is 2 if more than maxErrors lookups failed (unless
+// maxErrors is negative), or if there were lookups and none succeeded, and 0
+// otherwise. 404s are answers, not failures.
+func lookupExitCode(total oadoi.Summary, maxErrors int) int {
+	// Records lost to a recovered panic count as failed lookups.
+	if failed := total.Failed + total.Panics; maxErrors >= 0 && failed > maxErrors {
+		slog.Error(fmt.Sprintf("%d lookups failed, more than -max-errors %d.", failed, maxErrors))
+		return 2
 	}
-	for _, fileName := range filesToProcess {
-		log.Println("Processing", fileName)
-		processFile(fileName)
+	if total.Failed > 0 && total.Succeeded == 0 {
+		slog.Error(fmt.Sprintf("All %d lookups failed.", total.Failed))
+		return 2
 	}
+	return 0
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/artudis-utils/artudis-oadoi-report/oadoi"
+)
+
+// startMetricsServer serves metrics at /metrics on addr until the returned
+// stop function is called. The address is listened on before it returns,
+// so that a bad one fails the run before any lookups.
+func startMetricsServer(addr string, metrics *oadoi.Metrics) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Serving metrics.", "address", listener.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			slog.Error("Error serving metrics.", "error", err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			slog.Error("Error stopping metrics server.", "error", err)
+		}
+	}, nil
+}
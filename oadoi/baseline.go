@@ -0,0 +1,158 @@
+package oadoi
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Values of the "Baseline Change" column, comparing a row with the same
+// publication and DOI in a Baseline.
+const (
+	BaselineNew       string = "new"
+	BaselineChanged   string = "changed"
+	BaselineUnchanged string = "unchanged"
+)
+
+// A Baseline is an earlier report, read so that a run can mark which rows
+// are new, or have changed OA status, since then.
+type Baseline struct {
+	// apiOA is the "API - Available OA" value of each row, keyed by
+	// baselineKey. It is empty for reports without that column, which
+	// can only tell rows that are new.
+	apiOA map[string]string
+}
+
+// OpenBaseline reads a csv report, or a tsv one if the file name ends in
+// .tsv. The report needs a header row with at least the publication ID
+// column; columns may be in any order, named by their header or key, and
+// columns that aren't needed, or aren't known, are ignored.
+func OpenBaseline(fileName string) (*Baseline, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	comma := ','
+	if strings.EqualFold(filepath.Ext(fileName), ".tsv") {
+		comma = '\t'
+	}
+	baseline, err := readBaseline(file, comma)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return baseline, nil
+}
+
+func readBaseline(r io.Reader, comma rune) (*Baseline, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("baseline is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, string(utf8BOM)))
+		for _, column := range columns {
+			if name == column.header || name == column.key {
+				indexes[column.key] = i
+			}
+		}
+	}
+	if _, found := indexes["id"]; !found {
+		return nil, errors.New("baseline has no Artudis - ID column")
+	}
+
+	field := func(record []string, key string) string {
+		i, found := indexes[key]
+		if !found || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	baseline := &Baseline{apiOA: map[string]string{}}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The DOI looked up is only in the API - DOI column if oaDOI had a
+		// record of it.
+		doi := field(record, "identifier_value")
+		if doi == "" {
+			doi = field(record, "doi")
+		}
+		// A lookup that errored was written with an API - Available OA of
+		// false, which isn't known, so it's left blank, as if the column
+		// were missing, rather than taken for a flip if it's OA now.
+		apiOA := field(record, "api_oa")
+		if baselineErrored(record, indexes, field) {
+			apiOA = ""
+		}
+		baseline.apiOA[baselineKey(field(record, "id"), doi)] = apiOA
+	}
+	return baseline, nil
+}
+
+// baselineErrored reports whether the lookup of a baseline row errored: by
+// its API - Status if the report has that column, and otherwise by its
+// error columns, those of them that it has.
+func baselineErrored(record []string, indexes map[string]int, field func(record []string, key string) string) bool {
+	if _, found := indexes["status"]; found {
+		return field(record, "status") != StatusOK
+	}
+	httpStatus := field(record, "http_status")
+	return field(record, "get_error") != "" || field(record, "json_decode_error") != "" ||
+		(httpStatus != "" && !strings.HasPrefix(httpStatus, "2"))
+}
+
+// baselineKey identifies the rows of a publication for a DOI. DOIs are
+// compared ignoring case, as the report may have been written with
+// PreserveDOICase.
+func baselineKey(id string, doi string) string {
+	return id + "\x00" + NormalizeDOI(doi)
+}
+
+// Len is the number of publication and DOI pairs in the baseline.
+func (baseline *Baseline) Len() int {
+	return len(baseline.apiOA)
+}
+
+// Change compares the lookup of a DOI of a publication with the baseline,
+// returning BaselineNew if the baseline has no row for them, BaselineChanged
+// if oaDOI's OA status has flipped, and BaselineUnchanged otherwise,
+// including when the baseline's lookup errored. It returns "" for a lookup
+// that errored, whose OA status isn't known.
+func (baseline *Baseline) Change(id string, apiresponse APIResponse) string {
+	if baseline == nil {
+		return ""
+	}
+
+	apiOA, found := baseline.apiOA[baselineKey(id, apiresponse.DOI)]
+	switch {
+	case !found:
+		return BaselineNew
+	case apiresponse.Errored():
+		return ""
+	case apiOA != "" && !strings.EqualFold(apiOA, fmt.Sprint(apiresponse.IsOa)):
+		return BaselineChanged
+	}
+	return BaselineUnchanged
+}
@@ -0,0 +1,93 @@
+package oadoi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (client *Client) cachePath(doi string) string {
+	sum := sha256.Sum256([]byte(NormalizeDOI(doi)))
+	return filepath.Join(client.CacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// readCache returns the cached response for a DOI, unless there is none or
+// it is older than CacheTTL.
+func (client *Client) readCache(doi string) (APIResponse, bool) {
+	var apiResponse APIResponse
+
+	path := client.cachePath(doi)
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return apiResponse, false
+	}
+	if client.CacheTTL > 0 && time.Since(fileInfo.ModTime()) > client.CacheTTL {
+		return apiResponse, false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return apiResponse, false
+	}
+	err = json.Unmarshal(data, &apiResponse)
+	if err != nil {
+		slog.Warn("Ignoring unreadable cache entry.", "path", path, "doi", doi, "error", err)
+		return apiResponse, false
+	}
+
+	// Entries written before QueriedAt was recorded were fetched when they
+	// were written.
+	if apiResponse.QueriedAt.IsZero() {
+		apiResponse.QueriedAt = fileInfo.ModTime().UTC()
+	}
+	apiResponse.DOI = doi
+	return apiResponse, true
+}
+
+// writeCache stores a response under its DOI. The entry is written to a
+// temporary file and renamed into place, so concurrent readers never see a
+// partial entry and concurrent writers of the same DOI don't interleave.
+func (client *Client) writeCache(doi string, apiResponse APIResponse) {
+	data, err := json.Marshal(apiResponse)
+	if err != nil {
+		slog.Error("Error encoding cache entry.", "doi", doi, "error", err)
+		return
+	}
+
+	err = writeFileAtomic(client.cachePath(doi), data)
+	if err != nil {
+		slog.Error("Error writing cache entry.", "doi", doi, "error", err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of path
+// and renames it into place.
+func writeFileAtomic(path string, data []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+// cacheable reports whether a response is an answer worth keeping: a
+// decoded record, or oaDOI saying it has no record.
+func cacheable(apiResponse APIResponse) bool {
+	status := apiResponse.Status()
+	return status == StatusOK || status == StatusNotFound
+}
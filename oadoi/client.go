@@ -0,0 +1,604 @@
+package oadoi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const OADOIURL string = "https://api.oadoi.org/v2/"
+
+// A DOI that oaDOI is known to have a record for, used by Warmup.
+const warmupDOI string = "10.1038/nature12373"
+
+// ErrNotAttempted is returned by Lookup when the context was done before
+// the request could be made.
+var ErrNotAttempted = errors.New("lookup not attempted")
+
+var retryBaseDelay = time.Second
+
+// maxErrorBody is how much of a non-2xx or undecodable response body is kept
+// in ErrorBody.
+const maxErrorBody = 1024
+
+// DefaultMaxBodyBytes is the largest response body a Client decodes by
+// default. oaDOI records are a few kilobytes.
+const DefaultMaxBodyBytes = 4 * 1024 * 1024
+
+// Client looks up DOIs in the oaDOI API. Use NewClient to create one; the
+// exported fields may be changed before the first lookup.
+type Client struct {
+	// HTTPClient makes the requests. It may be replaced, for example with
+	// one that uses a different proxy or transport; if nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+	// BaseURL is the API endpoint, ending with a slash.
+	BaseURL   string
+	Email     string
+	UserAgent string
+	// DOIParam, if set, is the name of a query parameter to pass the DOI
+	// in, for gateways in front of oaDOI, instead of adding it to the path
+	// of BaseURL. BaseURL then needn't end with a slash, and may have a
+	// query of its own.
+	DOIParam string
+	// Timeout applies to each request, including reading the response.
+	Timeout time.Duration
+	// PreserveDOICase requests DOIs in the case they were written in, with
+	// only their prefix and whitespace stripped, instead of lowercased.
+	PreserveDOICase bool
+	// RawDir, if set, is a directory to archive the body of every response
+	// that is decoded in, as oaDOI sent it, named after the DOI; see
+	// rawPath. Unlike CacheDir, it is only written, never read.
+	RawDir string
+	// MaxBodyBytes is the largest response body to decode,
+	// DefaultMaxBodyBytes if 0. Larger bodies are decode errors, and aren't
+	// retried.
+	MaxBodyBytes int64
+	// Retries is the number of times to retry after a network error or a
+	// 5xx response. 429 responses are retried until MaxRetryWait is used up.
+	Retries      int
+	MaxRetryWait time.Duration
+	// CacheDir, if set, is a directory of responses keyed by DOI. Entries
+	// older than CacheTTL are fetched again, unless CacheTTL is 0.
+	CacheDir string
+	CacheTTL time.Duration
+	// RequestsPerSecond, if positive, limits how often requests are started,
+	// on top of the limit on how many run at a time.
+	RequestsPerSecond float64
+	// PerPrefixLimit, if positive, is how many requests to oaDOI run at a
+	// time for DOIs with the same registrant prefix, such as 10.1038.
+	PerPrefixLimit int
+	// AutoConcurrency, if set, starts by making MinConcurrency requests at
+	// a time, and raises that towards the concurrency given to NewClient
+	// while oaDOI keeps up, backing off on errors, slow responses and 429s.
+	AutoConcurrency bool
+	MinConcurrency  int
+	// MaxRequests, if positive, is how many requests to oaDOI to make,
+	// counting retries. Lookups after that are marked QuotaExceeded.
+	MaxRequests int64
+	// CrossRef, if set, fills in the title, publisher and year of DOIs that
+	// oaDOI has no record of from CrossRefURL. These requests share the
+	// timeout, rate limit and User-Agent of oaDOI requests, but aren't
+	// retried.
+	CrossRef    bool
+	CrossRefURL string
+	// Snapshot, if set, answers lookups instead of the API. DOIs missing
+	// from it are reported as not found, or looked up in the API if
+	// APIFallback is set.
+	Snapshot    *Snapshot
+	APIFallback bool
+	// HeadCheck, if set, checks that the best OA location of each DOI can
+	// be fetched, recording the status in BestOAURLStatus. The checks share
+	// the timeout, rate limit and User-Agent of oaDOI requests, but aren't
+	// retried or cached.
+	HeadCheck bool
+	// Metrics, if set, counts the requests made to oaDOI and how long they
+	// took.
+	Metrics *Metrics
+
+	tickets  chan bool
+	limiter  rateLimiter
+	prefixes prefixLimiter
+	adaptive adaptiveLimit
+	requests atomic.Int64
+}
+
+// NewClient returns a Client that makes at most concurrency requests at a
+// time, sharing one HTTP client so connections are reused.
+func NewClient(email string, concurrency int) *Client {
+	client := &Client{
+		HTTPClient:   newHTTPClient(concurrency),
+		BaseURL:      OADOIURL,
+		Email:        email,
+		Timeout:      30 * time.Second,
+		Retries:      3,
+		MaxRetryWait: 5 * time.Minute,
+		CrossRefURL:  CrossRefURL,
+		tickets:      make(chan bool, concurrency),
+	}
+	for i := 0; i < concurrency; i++ {
+		client.tickets <- true
+	}
+	return client
+}
+
+func newHTTPClient(maxConnsPerHost int) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: maxConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+func (client *Client) httpClient() *http.Client {
+	if client.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return client.HTTPClient
+}
+
+// Concurrency is the number of requests the client makes at a time, or with
+// AutoConcurrency, the most it makes.
+func (client *Client) Concurrency() int {
+	return cap(client.tickets)
+}
+
+// Lookup queries oaDOI, or the Snapshot if there is one, for a DOI.
+// Failures of the lookup itself (network errors, error statuses,
+// undecodable bodies) are recorded in the returned APIResponse; the error
+// is only non-nil if no request was made because ctx was done.
+func (client *Client) Lookup(ctx context.Context, doi string) (APIResponse, error) {
+	apiResponse, err := client.lookup(ctx, doi)
+	if err == nil && client.HeadCheck {
+		client.checkBestOAURL(ctx, &apiResponse)
+	}
+	return apiResponse, err
+}
+
+// lookup is Lookup without the HeadCheck.
+func (client *Client) lookup(ctx context.Context, doi string) (APIResponse, error) {
+	if client.Snapshot != nil {
+		apiResponse, found := client.lookupSnapshot(doi)
+		if found || !client.APIFallback {
+			return apiResponse, nil
+		}
+	}
+
+	if client.CacheDir != "" {
+		apiResponse, ok := client.readCache(doi)
+		if ok {
+			slog.Debug("Looked up DOI", "doi", doi, "status", apiResponse.Status(), "cached", true)
+			return apiResponse, nil
+		}
+	}
+
+	start := time.Now()
+	apiResponse, attempts := client.fetch(ctx, doi)
+	if apiResponse.notAttempted {
+		return apiResponse, ErrNotAttempted
+	}
+	elapsed := time.Since(start)
+	apiResponse.QueriedAt = time.Now().UTC()
+	slog.Debug("Looked up DOI", "doi", doi, "status", apiResponse.Status(), "http_status", apiResponse.HTTPStatus,
+		"attempts", attempts, "elapsed_ms", elapsed.Milliseconds())
+	if client.Metrics != nil {
+		client.Metrics.observeLookup(attempts, elapsed)
+	}
+
+	if client.CrossRef && apiResponse.Status() == StatusNotFound {
+		client.fillFromCrossRef(ctx, &apiResponse)
+	}
+
+	if client.CacheDir != "" && cacheable(apiResponse) {
+		client.writeCache(doi, apiResponse)
+	}
+
+	return apiResponse, nil
+}
+
+func (client *Client) lookupSnapshot(doi string) (APIResponse, bool) {
+	apiResponse := APIResponse{DOI: doi, FromSnapshot: true}
+	body, found, err := client.Snapshot.Lookup(doi)
+	if err != nil {
+		apiResponse.JSONDecodeError = fmt.Sprintf("reading snapshot: %v", err)
+		return apiResponse, true
+	}
+	apiResponse.APIResponseBody = body
+	slog.Debug("Looked up DOI", "doi", doi, "status", apiResponse.Status(), "snapshot", true)
+	return apiResponse, found
+}
+
+// fetch requests a DOI from oaDOI, retrying as needed. It returns the last
+// response and the number of attempts made, including the last.
+func (client *Client) fetch(ctx context.Context, doi string) (APIResponse, int) {
+	attempt, throttled := 0, 0
+	var waited time.Duration
+
+	for {
+		attempts := attempt + throttled + 1
+		slog.Debug("Requesting DOI", "doi", doi, "attempt", attempts)
+		apiResponse := client.attempt(ctx, doi)
+		if ctx.Err() != nil {
+			return apiResponse, attempts
+		}
+
+		var delay time.Duration
+		if apiResponse.StatusCode() == http.StatusTooManyRequests {
+			// Rate limiting doesn't count against Retries, only against
+			// the total time we're prepared to wait. A Retry-After of 0, or
+			// a date already past, backs off too, or waiting would never
+			// use MaxRetryWait up.
+			delay = apiResponse.retryAfter
+			if delay <= 0 {
+				delay = retryDelay(throttled)
+			}
+			throttled++
+			if waited+delay > client.MaxRetryWait {
+				return apiResponse, attempts
+			}
+			waited += delay
+		} else {
+			if attempt >= client.Retries || !retryable(apiResponse) {
+				return apiResponse, attempts
+			}
+			delay = retryDelay(attempt)
+			attempt++
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return apiResponse, attempts
+		}
+	}
+}
+
+// retryable reports whether a failed attempt might succeed if repeated:
+// network errors, 5xx responses and bodies that couldn't be decoded, which
+// are usually cut short, or had no record in them. 4xx responses and
+// bodies over MaxBodyBytes are permanent.
+func retryable(apiResponse APIResponse) bool {
+	if apiResponse.bodyTooLarge {
+		return false
+	}
+	if apiResponse.GETError != "" || apiResponse.JSONDecodeError != "" {
+		return true
+	}
+	code := apiResponse.StatusCode()
+	return code >= 500 && code <= 599
+}
+
+// retryDelay is an exponential backoff from retryBaseDelay, with jitter so
+// that workers which failed together don't retry together.
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as
+// an HTTP date. It returns a negative duration if the header is unusable.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return -1
+	}
+	seconds, err := strconv.Atoi(header)
+	if err == nil {
+		if seconds < 0 {
+			return -1
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return -1
+	}
+	if date.Before(now) {
+		return 0
+	}
+	return date.Sub(now)
+}
+
+// acquire waits for a ticket and then for the rate limit, if any. It
+// returns false, holding nothing, if ctx was done first; otherwise release
+// must be called once the request is finished.
+func (client *Client) acquire(ctx context.Context) (release func(), ok bool) {
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	if client.AutoConcurrency {
+		client.adaptive.start(client.tickets, client.MinConcurrency)
+	}
+	select {
+	case <-client.tickets:
+	case <-ctx.Done():
+		return nil, false
+	}
+	release = func() { client.tickets <- true }
+	if client.AutoConcurrency {
+		release = func() { client.adaptive.release(client.tickets) }
+	}
+
+	if client.RequestsPerSecond > 0 {
+		interval := time.Duration(float64(time.Second) / client.RequestsPerSecond)
+		if client.limiter.wait(ctx, interval) != nil {
+			release()
+			return nil, false
+		}
+	}
+	return release, true
+}
+
+// takeRequest counts a request against MaxRequests, returning false if
+// there are none left.
+func (client *Client) takeRequest() bool {
+	for {
+		requests := client.requests.Load()
+		if client.MaxRequests > 0 && requests >= client.MaxRequests {
+			return false
+		}
+		if client.requests.CompareAndSwap(requests, requests+1) {
+			return true
+		}
+	}
+}
+
+// Requests is the number of requests made to oaDOI so far.
+func (client *Client) Requests() int64 {
+	return client.requests.Load()
+}
+
+func (client *Client) newRequest(ctx context.Context, doi string) (*http.Request, error) {
+	requestURL, err := client.requestURL(doi)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", client.userAgent())
+	return req, nil
+}
+
+// requestDOI is doi as it is requested: normalized, or with PreserveDOICase
+// only trimmed.
+func (client *Client) requestDOI(doi string) string {
+	if client.PreserveDOICase {
+		return TrimDOI(doi)
+	}
+	return NormalizeDOI(doi)
+}
+
+// requestURL is the URL to request a DOI from: BaseURL with the DOI added
+// to the path, or with DOIParam, to the query.
+func (client *Client) requestURL(doi string) (string, error) {
+	if client.DOIParam == "" {
+		return client.BaseURL + doi + "?" + url.Values{"email": {client.Email}}.Encode(), nil
+	}
+
+	requestURL, err := url.Parse(client.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	query := requestURL.Query()
+	query.Set(client.DOIParam, doi)
+	query.Set("email", client.Email)
+	requestURL.RawQuery = query.Encode()
+	return requestURL.String(), nil
+}
+
+// userAgent identifies us to oaDOI, who ask API users to be identifiable.
+func (client *Client) userAgent() string {
+	if client.UserAgent != "" {
+		return client.UserAgent
+	}
+	return "artudis-oadoi-report (mailto:" + client.Email + ")"
+}
+
+func (client *Client) attempt(ctx context.Context, doi string) APIResponse {
+	var apiResponse APIResponse
+	apiResponse.DOI = doi
+
+	// Wait for the prefix first, so that the requests waiting for a busy
+	// prefix don't hold tickets that requests for other prefixes could use.
+	if client.PerPrefixLimit > 0 {
+		releasePrefix, ok := client.prefixes.acquire(ctx, registrantPrefix(doi), client.PerPrefixLimit)
+		if !ok {
+			apiResponse.notAttempted = true
+			return apiResponse
+		}
+		defer releasePrefix()
+	}
+
+	release, ok := client.acquire(ctx)
+	if !ok {
+		apiResponse.notAttempted = true
+		return apiResponse
+	}
+	defer release()
+
+	if !client.takeRequest() {
+		apiResponse.QuotaExceeded = true
+		return apiResponse
+	}
+
+	if client.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			if !apiResponse.notAttempted {
+				client.Metrics.observeRequest(apiResponse.Status(), time.Since(start))
+			}
+		}()
+	}
+	if client.AutoConcurrency {
+		start := time.Now()
+		defer func() {
+			if !apiResponse.notAttempted {
+				client.adaptive.observe(client.tickets, apiResponse.Status(), apiResponse.StatusCode(), time.Since(start))
+			}
+		}()
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	req, err := client.newRequest(requestCtx, client.requestDOI(doi))
+	if err != nil {
+		apiResponse.GETError = err.Error()
+		apiResponse.GETErrorCategory = GETErrorOther
+		return apiResponse
+	}
+
+	// A request cut short because the run was stopped, or its per-file
+	// deadline passed, is left for another run, like those that never
+	// started, rather than counted as a failure.
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			apiResponse.notAttempted = true
+			return apiResponse
+		}
+		apiResponse.GETError = err.Error()
+		apiResponse.GETErrorCategory = classifyGETError(err)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			apiResponse.Timeout = true
+			apiResponse.GETError = fmt.Sprintf("request timed out after %v: %v", client.Timeout, err)
+		}
+		return apiResponse
+	}
+
+	defer resp.Body.Close()
+
+	apiResponse.HTTPStatus = resp.Status
+	apiResponse.HTTPStatusCode = resp.StatusCode
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		apiResponse.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return apiResponse
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		apiResponse.ErrorBody = strings.TrimSpace(string(body))
+		return apiResponse
+	}
+
+	// Keep the start of the body, to show what couldn't be decoded.
+	maxBodyBytes := client.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = DefaultMaxBodyBytes
+	}
+	body := &io.LimitedReader{R: resp.Body, N: maxBodyBytes + 1}
+	head := &headWriter{max: maxErrorBody}
+	reader := io.TeeReader(body, head)
+	var raw bytes.Buffer
+	if client.RawDir != "" {
+		reader = io.TeeReader(reader, &raw)
+	}
+	err = json.NewDecoder(reader).Decode(&apiResponse.APIResponseBody)
+	if body.N <= 0 {
+		apiResponse.APIResponseBody = APIResponseBody{}
+		apiResponse.JSONDecodeError = fmt.Sprintf("response body is larger than %d bytes", maxBodyBytes)
+		apiResponse.ErrorBody = strings.TrimSpace(head.String())
+		apiResponse.bodyTooLarge = true
+		return apiResponse
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			apiResponse.notAttempted = true
+			return apiResponse
+		}
+		apiResponse.JSONDecodeError = err.Error()
+		apiResponse.ErrorBody = strings.TrimSpace(head.String())
+		if requestCtx.Err() == context.DeadlineExceeded {
+			apiResponse.Timeout = true
+			apiResponse.JSONDecodeError = fmt.Sprintf("response timed out after %v: %v", client.Timeout, err)
+		}
+		return apiResponse
+	}
+
+	// oaDOI sometimes answers 200 with an empty object, which would
+	// otherwise make a blank row that looks like a closed DOI.
+	if apiResponse.Doi == "" {
+		apiResponse.EmptyResponse = true
+		apiResponse.JSONDecodeError = "response has no DOI"
+		apiResponse.ErrorBody = strings.TrimSpace(head.String())
+		return apiResponse
+	}
+
+	if client.RawDir != "" {
+		// The decoder stops at the end of the record, before anything
+		// after it, such as a final newline.
+		_, err = io.Copy(io.Discard, reader)
+		if err == nil {
+			client.writeRaw(doi, raw.Bytes())
+		}
+	}
+
+	return apiResponse
+}
+
+// headWriter keeps the first max bytes written to it, and discards the
+// rest.
+type headWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if room := h.max - h.Len(); room > 0 {
+		h.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// Warmup looks up a DOI that oaDOI is known to have, to check the email and
+// connectivity before starting a long run. It is one attempt, without
+// retries, made as lookups are, so it waits its turn with the rate limit,
+// counts against MaxRequests and its body is read up to MaxBodyBytes.
+func (client *Client) Warmup(ctx context.Context) error {
+	apiResponse := client.attempt(ctx, warmupDOI)
+	code := apiResponse.StatusCode()
+	switch {
+	case apiResponse.notAttempted:
+		return ErrNotAttempted
+	case apiResponse.QuotaExceeded:
+		return errors.New("no requests left under the request quota")
+	case apiResponse.GETError != "":
+		return errors.New(apiResponse.GETError)
+	case code < 200 || code > 299:
+		var apiError struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal([]byte(apiResponse.ErrorBody), &apiError) == nil && apiError.Message != "" {
+			return fmt.Errorf("API returned %d: %s", code, apiError.Message)
+		}
+		return fmt.Errorf("API returned %s", apiResponse.HTTPStatus)
+	case apiResponse.EmptyResponse:
+		return errors.New("API response did not include a DOI")
+	case apiResponse.JSONDecodeError != "":
+		return fmt.Errorf("could not decode API response: %s", apiResponse.JSONDecodeError)
+	}
+	return nil
+}
@@ -0,0 +1,828 @@
+package oadoi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestAPI returns a client for a server that answers with the given
+// status codes in turn, and a pointer to the number of requests made.
+func newTestAPI(t *testing.T, statuses ...int) (*Client, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if requests < len(statuses) {
+			status = statuses[requests]
+		}
+		requests++
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"doi": "10.1234/abc", "is_oa": true}`))
+	}))
+	t.Cleanup(server.Close)
+
+	oldDelay := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	t.Cleanup(func() { retryBaseDelay = oldDelay })
+
+	client := NewClient("someone@example.com", 1)
+	client.BaseURL = server.URL + "/"
+	return client, &requests
+}
+
+func TestLookupRetries(t *testing.T) {
+	testTable := []struct {
+		statuses []int
+		requests int
+		status   string
+	}{
+		{[]int{200}, 1, StatusOK},
+		{[]int{500, 503, 200}, 3, StatusOK},
+		{[]int{500}, 4, StatusAPIError},
+		{[]int{404}, 1, StatusNotFound},
+		{[]int{429, 200}, 2, StatusOK},
+		{[]int{429, 429, 429, 429, 429, 200}, 6, StatusOK},
+	}
+
+	for _, tt := range testTable {
+		client, requests := newTestAPI(t, tt.statuses...)
+		apiResponse, err := client.Lookup(context.Background(), "10.1234/abc")
+		if err != nil || *requests != tt.requests || apiResponse.Status() != tt.status {
+			t.Errorf("Lookup with statuses %v => %d requests, %v, %v, want %d requests, %v",
+				tt.statuses, *requests, apiResponse.Status(), err, tt.requests, tt.status)
+		}
+	}
+}
+
+func TestLookupThrottledRetryAfterZero(t *testing.T) {
+	// newTestAPI answers 429 with Retry-After: 0, which would have the
+	// client request again at once, forever, if it didn't back off anyway.
+	client, requests := newTestAPI(t, 429)
+	client.MaxRetryWait = 50 * time.Millisecond
+
+	apiResponse, err := client.Lookup(context.Background(), "10.1234/abc")
+	if err != nil || *requests > 10 || apiResponse.StatusCode() != http.StatusTooManyRequests {
+		t.Errorf("Lookup with every response 429 and Retry-After: 0 => %d requests, %v, %v, want at most 10, 429",
+			*requests, apiResponse.StatusCode(), err)
+	}
+}
+
+func TestLookupTruncatedBody(t *testing.T) {
+	testTable := []struct {
+		bodies   []string
+		requests int
+		status   string
+		body     string
+	}{
+		{[]string{`{"doi": "10.1234/abc", "is_o`, `{"doi": "10.1234/abc", "is_oa": true}`}, 2, StatusOK, ""},
+		{[]string{`{"doi": "10.1234/abc", "is_o`}, 2, StatusDecodeError, `{"doi": "10.1234/abc", "is_o`},
+		{[]string{`{}`, `{"doi": "10.1234/abc", "is_oa": true}`}, 2, StatusOK, ""},
+		{[]string{`{}`}, 2, StatusDecodeError, `{}`},
+		{[]string{``}, 2, StatusDecodeError, ``},
+	}
+
+	for _, tt := range testTable {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tt.bodies[min(requests, len(tt.bodies)-1)]))
+			requests++
+		}))
+		defer server.Close()
+
+		oldDelay := retryBaseDelay
+		retryBaseDelay = time.Millisecond
+		defer func() { retryBaseDelay = oldDelay }()
+
+		client := NewClient("someone@example.com", 1)
+		client.BaseURL = server.URL + "/"
+		client.Retries = 1
+
+		apiResponse, _ := client.Lookup(context.Background(), "10.1234/abc")
+		if requests != tt.requests || apiResponse.Status() != tt.status || apiResponse.ErrorBody != tt.body ||
+			apiResponse.EmptyResponse != (tt.body == `{}`) {
+			t.Errorf("Lookup of bodies %q => %d requests, %v, error body %q, want %d requests, %v, error body %q",
+				tt.bodies, requests, apiResponse.Status(), apiResponse.ErrorBody, tt.requests, tt.status, tt.body)
+		}
+	}
+}
+
+func TestLookupMaxBodyBytes(t *testing.T) {
+	body := `{"doi": "10.1234/abc", "is_oa": true, "title": "` + strings.Repeat("x", 100) + `"}`
+	testTable := []struct {
+		maxBodyBytes int64
+		status       string
+		isOa         bool
+	}{
+		{0, StatusOK, true},
+		{int64(len(body)), StatusOK, true},
+		{int64(len(body)) - 1, StatusDecodeError, false},
+		{50, StatusDecodeError, false},
+	}
+
+	for _, tt := range testTable {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte(body))
+		}))
+		defer server.Close()
+
+		client := NewClient("someone@example.com", 1)
+		client.BaseURL = server.URL + "/"
+		client.MaxBodyBytes = tt.maxBodyBytes
+
+		apiResponse, _ := client.Lookup(context.Background(), "10.1234/abc")
+		if apiResponse.Status() != tt.status || apiResponse.IsOa != tt.isOa || requests != 1 {
+			t.Errorf("Lookup with MaxBodyBytes %d => %v, OA %v after %d requests (%s), want %v, OA %v after 1",
+				tt.maxBodyBytes, apiResponse.Status(), apiResponse.IsOa, requests, apiResponse.JSONDecodeError, tt.status, tt.isOa)
+		}
+	}
+}
+
+func TestLookupPreserveDOICase(t *testing.T) {
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		w.Write([]byte(`{"doi": "10.1234/abc.def", "is_oa": true}`))
+	}))
+	defer server.Close()
+
+	testTable := []struct {
+		preserve  bool
+		requested string
+		doi       string
+	}{
+		{false, "/10.1234/abc.def", "10.1234/abc.def"},
+		{true, "/10.1234/ABC.Def", "10.1234/ABC.Def"},
+	}
+
+	for _, tt := range testTable {
+		client := NewClient("someone@example.com", 1)
+		client.BaseURL = server.URL + "/"
+		client.PreserveDOICase = tt.preserve
+
+		apiResponse, _ := client.Lookup(context.Background(), "https://doi.org/10.1234/ABC.Def")
+		options := WriterOptions{PreserveDOICase: tt.preserve}
+		if requested != tt.requested || options.doi(apiResponse) != tt.doi {
+			t.Errorf("Lookup with PreserveDOICase %v => requested %q, DOI column %q, want %q, %q",
+				tt.preserve, requested, options.doi(apiResponse), tt.requested, tt.doi)
+		}
+	}
+}
+
+func TestLookupHTTPClient(t *testing.T) {
+	testTable := []struct {
+		status     int
+		httpStatus string
+		result     string
+	}{
+		{200, "200 OK", StatusOK},
+		{500, "500 Internal Server Error", StatusAPIError},
+	}
+
+	for _, tt := range testTable {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(`{"doi": "10.1234/abc", "is_oa": true}`))
+		}))
+
+		client := NewClient("someone@example.com", 1)
+		client.HTTPClient = server.Client()
+		client.BaseURL = server.URL + "/"
+		client.Retries = 0
+
+		apiResponse, _ := client.Lookup(context.Background(), "10.1234/abc")
+		if apiResponse.HTTPStatus != tt.httpStatus || apiResponse.Status() != tt.result {
+			t.Errorf("Lookup with a %d response => %v %v, want %v %v",
+				tt.status, apiResponse.HTTPStatus, apiResponse.Status(), tt.httpStatus, tt.result)
+		}
+		server.Close()
+	}
+}
+
+func TestLookupTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"doi": "10.1234/abc", "is_oa": true}`))
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTable := []struct {
+		caFile             string
+		insecureSkipVerify bool
+		status             string
+	}{
+		{"", false, StatusNetworkError},
+		{caFile, false, StatusOK},
+		{"", true, StatusOK},
+	}
+
+	for _, tt := range testTable {
+		client := NewClient("someone@example.com", 1)
+		client.BaseURL = server.URL + "/"
+		client.Retries = 0
+
+		config, err := LoadTLSConfig(tt.caFile, tt.insecureSkipVerify)
+		if err == nil {
+			err = client.SetTLSConfig(config)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		apiResponse, _ := client.Lookup(context.Background(), "10.1234/abc")
+		if apiResponse.Status() != tt.status {
+			t.Errorf("Lookup with CA file %q, skip verify %v => %v (%s), want %v",
+				tt.caFile, tt.insecureSkipVerify, apiResponse.Status(), apiResponse.GETError, tt.status)
+		}
+	}
+
+	_, err = LoadTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), false)
+	if err == nil {
+		t.Errorf("LoadTLSConfig of a missing file => nil error, want an error")
+	}
+}
+
+func TestLookupErrorBody(t *testing.T) {
+	message := `{"HTTP_status_code": 422, "error": true, "message": "invalid DOI"}`
+	testTable := []struct {
+		body      string
+		errorBody string
+	}{
+		{message + "\n", message},
+		{strings.Repeat("x", 2*maxErrorBody), strings.Repeat("x", maxErrorBody)},
+	}
+
+	for _, tt := range testTable {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(tt.body))
+		}))
+
+		client := NewClient("someone@example.com", 1)
+		client.BaseURL = server.URL + "/"
+
+		apiResponse, _ := client.Lookup(context.Background(), "10.1234/abc")
+		if apiResponse.ErrorBody != tt.errorBody || apiResponse.JSONDecodeError != "" {
+			t.Errorf("Lookup with a 422 response => ErrorBody %q, JSONDecodeError %q, want %q and no decode error",
+				apiResponse.ErrorBody, apiResponse.JSONDecodeError, tt.errorBody)
+		}
+		server.Close()
+	}
+}
+
+func TestLookupRequestsPerSecond(t *testing.T) {
+	client, requests := newTestAPI(t, 200)
+	client.RequestsPerSecond = 50
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		client.Lookup(context.Background(), "10.1234/abc")
+	}
+	elapsed := time.Since(start)
+
+	// The first request goes straight away, the other four 20ms apart.
+	if *requests != 5 || elapsed < 80*time.Millisecond {
+		t.Errorf("5 lookups at 50 requests per second took %v, want at least 80ms", elapsed)
+	}
+}
+
+func TestLookupNotAttempted(t *testing.T) {
+	client, requests := newTestAPI(t, 200)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := client.Lookup(ctx, "10.1234/abc")
+	if err != ErrNotAttempted || *requests != 0 {
+		t.Errorf("Lookup with a cancelled context => %v after %d requests, want %v after 0", err, *requests, ErrNotAttempted)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	testTable := []struct {
+		status int
+		body   string
+		err    string
+	}{
+		{http.StatusOK, `{"doi": "10.1038/nature12373", "is_oa": true}`, ""},
+		{http.StatusUnprocessableEntity, `{"error": true, "message": "invalid email"}`, "API returned 422: invalid email"},
+		{http.StatusInternalServerError, `<html>`, "API returned 500 Internal Server Error"},
+		{http.StatusOK, `{}`, "API response did not include a DOI"},
+	}
+
+	for _, tt := range testTable {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		defer server.Close()
+
+		client := NewClient("someone@example.com", 1)
+		client.BaseURL = server.URL + "/"
+		err := client.Warmup(context.Background())
+		message := ""
+		if err != nil {
+			message = err.Error()
+		}
+		if message != tt.err || client.Requests() != 1 {
+			t.Errorf("Warmup against %d %s => %q after %d requests, want %q after 1", tt.status, tt.body, message, client.Requests(), tt.err)
+		}
+	}
+
+	// The warmup counts against MaxRequests like any other request.
+	client, requests := newTestAPI(t, 200)
+	client.MaxRequests = 1
+	client.Warmup(context.Background())
+	err := client.Warmup(context.Background())
+	if err == nil || *requests != 1 {
+		t.Errorf("Warmup past MaxRequests => %v after %d requests, want an error after 1", err, *requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	testTable := []struct {
+		input  string
+		output time.Duration
+	}{
+		{"", -1},
+		{"0", 0},
+		{"120", 2 * time.Minute},
+		{"-5", -1},
+		{"Thu, 01 Jun 2017 12:00:30 GMT", 30 * time.Second},
+		{"Thu, 01 Jun 2017 11:00:00 GMT", 0},
+		{"soon", -1},
+	}
+
+	for _, tt := range testTable {
+		realOutput := parseRetryAfter(tt.input, now)
+		if realOutput != tt.output {
+			t.Errorf("parseRetryAfter(%q) => %v, want %v", tt.input, realOutput, tt.output)
+		}
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := NewClient("someone@example.com", 1)
+	client.BaseURL = server.URL + "/"
+	client.Timeout = 20 * time.Millisecond
+	client.Retries = 0
+
+	apiResponse, _ := client.Lookup(context.Background(), "10.1234/abc")
+	if apiResponse.Status() != StatusTimeout || !strings.Contains(apiResponse.GETError, "timed out after 20ms") || apiResponse.GETErrorCategory != GETErrorTimeout {
+		t.Errorf("Lookup against a slow server => %v %q (%s), want %v", apiResponse.Status(), apiResponse.GETError, apiResponse.GETErrorCategory, StatusTimeout)
+	}
+}
+
+func TestClassifyGETError(t *testing.T) {
+	testTable := []struct {
+		input  error
+		output string
+	}{
+		{&url.Error{Op: "Get", Err: &net.DNSError{Err: "no such host", Name: "api.oadoi.org", IsNotFound: true}}, GETErrorDNS},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, GETErrorConnectionRefused},
+		{&url.Error{Op: "Get", Err: context.DeadlineExceeded}, GETErrorTimeout},
+		{&url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}, GETErrorTLS},
+		{&url.Error{Op: "Get", Err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}}, GETErrorTLS},
+		{&url.Error{Op: "Get", Err: errors.New("EOF")}, GETErrorOther},
+	}
+
+	for _, tt := range testTable {
+		realOutput := classifyGETError(tt.input)
+		if realOutput != tt.output {
+			t.Errorf("classifyGETError(%v) => %v, want %v", tt.input, realOutput, tt.output)
+		}
+	}
+}
+
+func TestLookupConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	client := NewClient("someone@example.com", 1)
+	client.BaseURL = server.URL + "/"
+	client.Retries = 0
+
+	apiResponse, _ := client.Lookup(context.Background(), "10.1234/abc")
+	if apiResponse.GETErrorCategory != GETErrorConnectionRefused {
+		t.Errorf("Lookup against a closed server => %q (%s), want %s", apiResponse.GETErrorCategory, apiResponse.GETError, GETErrorConnectionRefused)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	client := NewClient("someone@example.com", 1)
+	client.BaseURL = server.URL + "/"
+	client.Retries = 0
+
+	client.Lookup(context.Background(), "10.1234/abc")
+	if want := "artudis-oadoi-report (mailto:someone@example.com)"; received != want {
+		t.Errorf("User-Agent => %q, want %q", received, want)
+	}
+
+	client.UserAgent = "custom/1.0"
+	client.Lookup(context.Background(), "10.1234/abc")
+	if received != "custom/1.0" {
+		t.Errorf("User-Agent => %q, want %q", received, "custom/1.0")
+	}
+}
+
+func TestRequestEmail(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.URL.Query().Get("email")
+	}))
+	defer server.Close()
+
+	client := NewClient("some.one+oadoi@example.com", 1)
+	client.BaseURL = server.URL + "/"
+	client.Retries = 0
+
+	client.Lookup(context.Background(), "10.1234/abc")
+	if received != client.Email {
+		t.Errorf("email => %q, want %q", received, client.Email)
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	var testTable = []struct {
+		baseURL  string
+		doiParam string
+		doi      string
+		url      string
+	}{
+		{OADOIURL, "", "10.1234/abc", "https://api.oadoi.org/v2/10.1234/abc?email=some.one%2Boadoi%40example.com"},
+		{"https://gateway.example.com/oadoi", "doi", "10.1234/abc", "https://gateway.example.com/oadoi?doi=10.1234%2Fabc&email=some.one%2Boadoi%40example.com"},
+		{"https://gateway.example.com/oadoi?key=a&b", "doi", "10.1234/a&b=c d", "https://gateway.example.com/oadoi?b=&doi=10.1234%2Fa%26b%3Dc+d&email=some.one%2Boadoi%40example.com&key=a"},
+	}
+
+	for _, tt := range testTable {
+		client := NewClient("some.one+oadoi@example.com", 1)
+		client.BaseURL = tt.baseURL
+		client.DOIParam = tt.doiParam
+		url, err := client.requestURL(tt.doi)
+		if err != nil || url != tt.url {
+			t.Errorf("requestURL(%v) with BaseURL %v, DOIParam %q => %v, %v, want %v", tt.doi, tt.baseURL, tt.doiParam, url, err, tt.url)
+		}
+	}
+}
+
+func TestLookupDOIParam(t *testing.T) {
+	var path, doi string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, doi = r.URL.Path, r.URL.Query().Get("doi")
+		w.Write([]byte(`{"doi": "10.1234/abc"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient("someone@example.com", 1)
+	client.BaseURL = server.URL + "/gateway"
+	client.DOIParam = "doi"
+
+	apiResponse, err := client.Lookup(context.Background(), "10.1234/ABC")
+	if err != nil || apiResponse.Status() != StatusOK || path != "/gateway" || doi != "10.1234/abc" {
+		t.Errorf("Lookup with DOIParam => %v, %v, requested %v with doi %q, want ok, /gateway with 10.1234/abc", apiResponse.Status(), err, path, doi)
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	client, requests := newTestAPI(t, 200)
+	client.CacheDir = t.TempDir()
+
+	first, _ := client.Lookup(context.Background(), "https://doi.org/10.1234/ABC")
+	second, _ := client.Lookup(context.Background(), "10.1234/abc")
+	if *requests != 1 {
+		t.Errorf("Lookup made %d requests for a cached DOI, want 1", *requests)
+	}
+	if second.DOI != "10.1234/abc" || second.Doi != first.Doi || !second.IsOa || !second.QueriedAt.Equal(first.QueriedAt) {
+		t.Errorf("cached Lookup => %+v, want the response to %+v", second, first)
+	}
+}
+
+func TestLookupRawDir(t *testing.T) {
+	client, _ := newTestAPI(t, 200, 404, 200)
+	client.RawDir = t.TempDir()
+
+	client.Lookup(context.Background(), "https://doi.org/10.1234/ABC")
+	client.Lookup(context.Background(), "10.1234/missing")
+
+	entries, _ := os.ReadDir(client.RawDir)
+	raw, err := os.ReadFile(filepath.Join(client.RawDir, "10.1234%2Fabc.json"))
+	if want := `{"doi": "10.1234/abc", "is_oa": true}`; len(entries) != 1 || err != nil || string(raw) != want {
+		t.Errorf("Lookup with RawDir wrote %d files, %q, %v, want only %q", len(entries), raw, err, want)
+	}
+
+	client.RawDir = filepath.Join(client.RawDir, "missing")
+	apiResponse, _ := client.Lookup(context.Background(), "10.1234/abc")
+	if apiResponse.Status() != StatusOK {
+		t.Errorf("Lookup with an unwritable RawDir => %v, want %v", apiResponse.Status(), StatusOK)
+	}
+}
+
+func TestLookupCrossRef(t *testing.T) {
+	crossRef := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/10.1234/abc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"message": {"title": ["A Title"], "publisher": "A Publisher", "issued": {"date-parts": [[2019, 3]]}}}`))
+	}))
+	defer crossRef.Close()
+
+	testTable := []struct {
+		enabled bool
+		status  int
+		doi     string
+		output  APIResponseBody
+		source  string
+	}{
+		{false, 404, "10.1234/abc", APIResponseBody{}, ""},
+		{true, 404, "10.1234/abc", APIResponseBody{Title: "A Title", Publisher: "A Publisher", Year: 2019}, "crossref"},
+		{true, 404, "10.1234/missing", APIResponseBody{}, ""},
+		{true, 200, "10.1234/abc", APIResponseBody{Doi: "10.1234/abc", IsOa: true}, ""},
+	}
+
+	for _, tt := range testTable {
+		client, _ := newTestAPI(t, tt.status)
+		client.CrossRef = tt.enabled
+		client.CrossRefURL = crossRef.URL + "/"
+		apiResponse, _ := client.Lookup(context.Background(), tt.doi)
+		body := apiResponse.APIResponseBody
+		if body.Title != tt.output.Title || body.Publisher != tt.output.Publisher || body.Year != tt.output.Year || apiResponse.MetadataSource != tt.source {
+			t.Errorf("Lookup(%v) with CrossRef %v => %+v, %q, want %+v, %q", tt.doi, tt.enabled, body, apiResponse.MetadataSource, tt.output, tt.source)
+		}
+	}
+}
+
+func TestLookupHeadCheck(t *testing.T) {
+	var methods []string
+	locations := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method+" "+r.URL.Path)
+		switch {
+		case r.URL.Path == "/no-head" && r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.URL.Path == "/gone":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer locations.Close()
+
+	testTable := []struct {
+		path    string
+		status  string
+		methods []string
+	}{
+		{"/ok", "200 OK", []string{"HEAD /ok"}},
+		{"/gone", "404 Not Found", []string{"HEAD /gone"}},
+		{"/no-head", "200 OK", []string{"HEAD /no-head", "GET /no-head"}},
+	}
+
+	for _, tt := range testTable {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"doi": "10.1234/abc", "is_oa": true, "best_oa_location": {"url": "` + locations.URL + tt.path + `"}}`))
+		}))
+		defer api.Close()
+
+		client := NewClient("someone@example.com", 1)
+		client.BaseURL = api.URL + "/"
+		client.HeadCheck = true
+		methods = nil
+
+		apiResponse, _ := client.Lookup(context.Background(), "10.1234/abc")
+		if apiResponse.BestOAURLStatus != tt.status || !reflect.DeepEqual(methods, tt.methods) {
+			t.Errorf("Lookup with HeadCheck of %v => %q after %v, want %q after %v",
+				tt.path, apiResponse.BestOAURLStatus, methods, tt.status, tt.methods)
+		}
+	}
+}
+
+func TestLookupSnapshot(t *testing.T) {
+	snapshot, err := OpenSnapshot("testdata/snapshot.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	if snapshot.Len() != 2 {
+		t.Errorf("snapshot has %d DOIs, want 2", snapshot.Len())
+	}
+
+	testTable := []struct {
+		doi         string
+		apiFallback bool
+		status      string
+		title       string
+		requests    int
+	}{
+		{"10.1234/abc", false, StatusOK, "In the Snapshot", 0},
+		{"https://doi.org/10.1234/def", false, StatusOK, "Also in the Snapshot", 0},
+		{"10.1234/missing", false, StatusNotFound, "", 0},
+		{"10.1234/missing", true, StatusOK, "", 1},
+	}
+
+	for _, tt := range testTable {
+		client, requests := newTestAPI(t, 200)
+		client.Snapshot = snapshot
+		client.APIFallback = tt.apiFallback
+		apiResponse, err := client.Lookup(context.Background(), tt.doi)
+		if err != nil || apiResponse.Status() != tt.status || apiResponse.Title != tt.title || *requests != tt.requests {
+			t.Errorf("Lookup(%v) with fallback %v => %v, %q, %d requests, %v, want %v, %q, %d requests",
+				tt.doi, tt.apiFallback, apiResponse.Status(), apiResponse.Title, *requests, err, tt.status, tt.title, tt.requests)
+		}
+	}
+}
+
+func TestOpenSnapshotErrors(t *testing.T) {
+	testTable := []struct {
+		contents string
+		ok       bool
+	}{
+		{"{\"doi\": \"10.1234/abc\"}\n", true},
+		{"{\"doi\": \"10.1234/abc\"}", true},
+		{"not json\n", false},
+		{"{\"title\": \"no DOI\"}\n", false},
+		{"\x1f\x8b\x08\x00", false},
+	}
+
+	for _, tt := range testTable {
+		fileName := filepath.Join(t.TempDir(), "snapshot.jsonl")
+		err := os.WriteFile(fileName, []byte(tt.contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := OpenSnapshot(fileName)
+		if (err == nil) != tt.ok {
+			t.Errorf("OpenSnapshot(%q) => %v, want ok %v", tt.contents, err, tt.ok)
+		}
+		if snapshot != nil {
+			snapshot.Close()
+		}
+	}
+}
+
+func TestLookupMaxRequests(t *testing.T) {
+	testTable := []struct {
+		statuses []int
+		lookups  int
+		requests int
+		status   string
+	}{
+		{[]int{200}, 2, 2, StatusOK},
+		{[]int{200}, 3, 2, StatusOverQuota},
+		{[]int{500}, 1, 2, StatusOverQuota},
+	}
+
+	for _, tt := range testTable {
+		client, requests := newTestAPI(t, tt.statuses...)
+		client.MaxRequests = 2
+
+		var apiResponse APIResponse
+		for i := 0; i < tt.lookups; i++ {
+			apiResponse, _ = client.Lookup(context.Background(), "10.1234/abc")
+		}
+		if *requests != tt.requests || client.Requests() != int64(tt.requests) || apiResponse.Status() != tt.status {
+			t.Errorf("%d lookups with statuses %v => %d requests, %v, want %d requests, %v",
+				tt.lookups, tt.statuses, *requests, apiResponse.Status(), tt.requests, tt.status)
+		}
+	}
+}
+
+func TestLookupMetrics(t *testing.T) {
+	client, _ := newTestAPI(t, 500, 200, 404)
+	client.Metrics = &Metrics{Progress: &Progress{}}
+	client.Metrics.Progress.RecordsDone.Add(2)
+
+	client.Lookup(context.Background(), "10.1234/abc")
+	client.Lookup(context.Background(), "10.1234/def")
+
+	recorder := httptest.NewRecorder()
+	client.Metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, want := range []string{
+		`oadoi_requests_total{status="api-error"} 1`,
+		`oadoi_requests_total{status="ok"} 1`,
+		`oadoi_requests_total{status="not-found"} 1`,
+		`oadoi_request_duration_seconds_bucket{le="+Inf"} 3`,
+		`oadoi_request_duration_seconds_count 3`,
+		`oadoi_retries_total 1`,
+		`oadoi_lookup_duration_seconds_count 2`,
+		`oadoi_records_processed_total 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics after 3 requests => %q, want it to contain %q", body, want)
+		}
+	}
+}
+
+func TestLookupPerPrefixLimit(t *testing.T) {
+	var mutex sync.Mutex
+	running, maxRunning := map[string]int{}, map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := registrantPrefix(strings.TrimPrefix(r.URL.Path, "/"))
+		mutex.Lock()
+		running[prefix]++
+		maxRunning[prefix] = max(maxRunning[prefix], running[prefix])
+		mutex.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		running[prefix]--
+		mutex.Unlock()
+		w.Write([]byte(`{"doi": "10.1234/abc"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient("someone@example.com", 4)
+	client.BaseURL = server.URL + "/"
+	client.PerPrefixLimit = 1
+
+	var waitgroup sync.WaitGroup
+	for _, doi := range []string{"10.1/a", "10.1/b", "10.1/c", "10.2/a"} {
+		waitgroup.Add(1)
+		go func() {
+			defer waitgroup.Done()
+			client.Lookup(context.Background(), doi)
+		}()
+	}
+	waitgroup.Wait()
+
+	if maxRunning["10.1"] != 1 || maxRunning["10.2"] != 1 {
+		t.Errorf("lookups with PerPrefixLimit 1 => at most %v requests at a time, want 1 for each prefix", maxRunning)
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	ok := func(latency time.Duration) [3]any { return [3]any{StatusOK, 200, latency} }
+	throttled := [3]any{StatusAPIError, 429, time.Millisecond}
+	failed := [3]any{StatusNetworkError, 0, time.Millisecond}
+	repeat := func(n int, outcome [3]any) [][3]any {
+		outcomes := make([][3]any, n)
+		for i := range outcomes {
+			outcomes[i] = outcome
+		}
+		return outcomes
+	}
+
+	var testTable = []struct {
+		name     string
+		outcomes [][3]any
+		limit    int
+	}{
+		{"start", nil, 2},
+		{"one window", repeat(2, ok(time.Millisecond)), 3},
+		{"up to max", repeat(50, ok(time.Millisecond)), 8},
+		{"throttled", append(repeat(50, ok(time.Millisecond)), throttled), 4},
+		{"throttled twice in a row", append(repeat(50, ok(time.Millisecond)), throttled, throttled), 4},
+		{"throttled after cooldown", append(append(repeat(50, ok(time.Millisecond)), throttled), append(repeat(7, failed), throttled)...), 2},
+		{"failed", append(repeat(5, ok(time.Millisecond)), failed), 3},
+		{"slow", append(repeat(5, ok(time.Millisecond)), repeat(4, ok(10*time.Millisecond))...), 3},
+		{"not below min", repeat(3, throttled), 2},
+	}
+
+	for _, tt := range testTable {
+		tickets := make(chan bool, 8)
+		for i := 0; i < cap(tickets); i++ {
+			tickets <- true
+		}
+		var limit adaptiveLimit
+		limit.start(tickets, 2)
+		for _, outcome := range tt.outcomes {
+			limit.observe(tickets, outcome[0].(string), outcome[1].(int), outcome[2].(time.Duration))
+		}
+		if limit.limit != tt.limit || len(tickets) != tt.limit {
+			t.Errorf("adaptiveLimit(%v) => limit %v with %v tickets, want %v", tt.name, limit.limit, len(tickets), tt.limit)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package oadoi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// row is what a csv row is made from: one OA location of one API response
+// of a record.
+type row struct {
+	record       Record
+	apiresponse  APIResponse
+	location     OaLocation
+	locationKind string
+	artudisOA    bool
+	highestLevel string
+	options      *WriterOptions
+}
+
+// A column is one field of the csv report.
+type column struct {
+	key    string
+	header string
+	value  func(r row) string
+}
+
+// columns are all the csv columns, in the default order.
+var columns = []column{
+	{"id", "Artudis - ID", func(r row) string { return r.record.Publication.ID }},
+	{"type", "Artudis - Publication Type", func(r row) string { return r.record.Publication.Type }},
+	{"artudis_oa", "Artudis - Available OA", func(r row) string { return strconv.FormatBool(r.artudisOA) }},
+	{"artudis_best_type", "Artudis - Best Type OA", func(r row) string { return r.highestLevel }},
+	{"api_oa", "API - Available OA", func(r row) string { return strconv.FormatBool(r.apiresponse.IsOa) }},
+	{"best_oa_version", "API - Best OA Location Version", func(r row) string { return r.location.Version }},
+	{"doi", "API - DOI", func(r row) string { return r.options.doi(r.apiresponse) }},
+	{"best_oa_url", "API - Best OA Location URL", func(r row) string { return r.location.URL }},
+	{"title", "API - Title", func(r row) string { return r.apiresponse.Title }},
+	{"http_status", "API - HTTP Response Status", func(r row) string { return r.apiresponse.HTTPStatus }},
+	{"json_decode_error", "API - JSON Decode Error", func(r row) string { return r.apiresponse.JSONDecodeError }},
+	{"get_error", "API - GET Error", func(r row) string { return r.apiresponse.GETError }},
+	{"sherpa_link", "API - Sherpa Link", func(r row) string { return r.options.sherpaLink(r.apiresponse.sherpaISSNs()) }},
+	{"status", "API - Status", func(r row) string { return r.apiresponse.Status() }},
+	{"identifier_scheme", "Artudis - Identifier Scheme", func(r row) string { return r.apiresponse.Scheme }},
+	{"oa_status", "API - OA Status", func(r row) string { return r.apiresponse.OaStatus }},
+	{"best_oa_license", "API - Best OA License", func(r row) string { return r.location.License }},
+	{"oa_location", "API - OA Location", func(r row) string { return r.locationKind }},
+	{"oa_mismatch", "OA Mismatch", func(r row) string { return strconv.FormatBool(oaMismatch(r.artudisOA, r.apiresponse)) }},
+	{"source_file", "Artudis - Source File", func(r row) string { return r.record.SourceFile }},
+	{"queried_at", "API - Queried At", func(r row) string { return formatTime(r.apiresponse.QueriedAt) }},
+	{"error_body", "API - Error Body", func(r row) string { return r.apiresponse.ErrorBody }},
+	{"publisher", "API - Publisher", func(r row) string { return r.apiresponse.Publisher }},
+	{"journal_name", "API - Journal Name", func(r row) string { return r.apiresponse.JournalName }},
+	{"journal_is_oa", "API - Journal Is OA", func(r row) string { return strconv.FormatBool(r.apiresponse.JournalIsOa) }},
+	{"year", "API - Year", func(r row) string { return formatNonZero(r.apiresponse.Year) }},
+	{"metadata_source", "API - Metadata Source", func(r row) string { return r.apiresponse.MetadataSource }},
+	{"best_oa_pdf_url", "API - Best OA PDF URL", func(r row) string { return r.location.URLForPdf }},
+	{"best_oa_host_type", "API - Best OA Host Type", func(r row) string { return r.location.HostType }},
+	{"best_oa_evidence", "API - Best OA Evidence", func(r row) string { return r.location.Evidence }},
+	{"genre", "API - Genre", func(r row) string { return r.apiresponse.Genre }},
+	{"data_standard", "API - Data Standard", func(r row) string { return formatNonZero(r.apiresponse.DataStandard) }},
+	{"journal_issns", "API - Journal ISSNs", func(r row) string { return string(r.apiresponse.JournalIssns) }},
+	{"identifier_value", "Artudis - Identifier Value", func(r row) string { return r.apiresponse.DOI }},
+	{"best_oa_url_status", "API - Best OA URL Status", func(r row) string { return r.apiresponse.BestOAURLStatus }},
+	{"http_status_code", "API - HTTP Status Code", func(r row) string { return formatNonZero(r.apiresponse.StatusCode()) }},
+	{"published_date", "API - Published Date", func(r row) string { return formatTime(r.apiresponse.PublishedTime()) }},
+	{"published_date_raw", "API - Published Date (Raw)", func(r row) string { return r.apiresponse.PublishedDate }},
+	{"updated", "API - Updated", func(r row) string { return formatTime(r.apiresponse.UpdatedTime()) }},
+	{"updated_raw", "API - Updated (Raw)", func(r row) string { return r.apiresponse.Updated }},
+	{"dois_checked", "API - DOIs Checked", func(r row) string { return formatNonZero(r.apiresponse.DOIsChecked) }},
+	{"get_error_category", "API - GET Error Category", func(r row) string { return r.apiresponse.GETErrorCategory }},
+	{"author_count", "API - Author Count", func(r row) string { return strconv.Itoa(len(r.apiresponse.ZAuthors)) }},
+	{"first_author", "API - First Author", func(r row) string { return r.apiresponse.ZAuthors.FirstAuthor() }},
+	{"low_weight_oa", "Artudis - Low Weight OA", func(r row) string {
+		return strconv.FormatBool(r.record.Publication.LowWeightOA(r.options.AttachmentWeights))
+	}},
+	{"artudis_external_url", "Artudis - External URL", func(r row) string {
+		return r.record.Publication.ArtudisExternalURL(r.options.AttachmentWeights)
+	}},
+	{"baseline_change", "Baseline Change", func(r row) string { return r.options.Baseline.Change(r.record.Publication.ID, r.apiresponse) }},
+	{"journal_issn_l", "API - Journal ISSN-L", func(r row) string { return string(r.apiresponse.JournalIssnL) }},
+}
+
+// columnTypes are the JSON types of the columns that flatjson doesn't write
+// as strings.
+var columnTypes = map[string]string{
+	"artudis_oa":       "boolean",
+	"api_oa":           "boolean",
+	"oa_mismatch":      "boolean",
+	"journal_is_oa":    "boolean",
+	"low_weight_oa":    "boolean",
+	"year":             "number",
+	"data_standard":    "number",
+	"http_status_code": "number",
+	"dois_checked":     "number",
+	"author_count":     "number",
+}
+
+// jsonValue is the value of the column in a row, as formatted for csv,
+// converted to the column's JSON type. An empty number is unknown, and is
+// null.
+func (column column) jsonValue(value string) interface{} {
+	switch columnTypes[column.key] {
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err == nil {
+			return b
+		}
+	case "number":
+		if value == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err == nil {
+			return n
+		}
+	}
+	return value
+}
+
+// ColumnKeys are the names of the csv columns, in the default order.
+func ColumnKeys() []string {
+	keys := make([]string, len(columns))
+	for i, column := range columns {
+		keys[i] = column.key
+	}
+	return keys
+}
+
+// selectColumns returns the columns with the given keys, in that order, or
+// every column if keys is empty.
+func selectColumns(keys []string) ([]column, error) {
+	if len(keys) == 0 {
+		return columns, nil
+	}
+
+	selected := make([]column, 0, len(keys))
+	for _, key := range keys {
+		found := false
+		for _, column := range columns {
+			if column.key == key {
+				selected = append(selected, column)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q, valid columns are %s", key, strings.Join(ColumnKeys(), ", "))
+		}
+	}
+	return selected, nil
+}
+
+// formatNonZero formats a number, or as an empty string if it is 0, which
+// in oaDOI responses means unknown.
+func formatNonZero(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
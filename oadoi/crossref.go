@@ -0,0 +1,85 @@
+package oadoi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+const CrossRefURL string = "https://api.crossref.org/works/"
+
+// crossRefWork is the part of a CrossRef works response that we use.
+type crossRefWork struct {
+	Message struct {
+		Title     []string `json:"title"`
+		Publisher string   `json:"publisher"`
+		Issued    struct {
+			DateParts [][]int `json:"date-parts"`
+		} `json:"issued"`
+	} `json:"message"`
+}
+
+// fillFromCrossRef looks up a DOI that oaDOI has no record of in CrossRef,
+// and fills in the title, publisher and year of apiResponse from it. The
+// oaDOI status is kept; a failed CrossRef lookup is only logged.
+func (client *Client) fillFromCrossRef(ctx context.Context, apiResponse *APIResponse) {
+	work, err := client.crossRefWork(ctx, NormalizeDOI(apiResponse.DOI))
+	if err != nil {
+		slog.Debug("CrossRef lookup failed", "doi", apiResponse.DOI, "error", err)
+		return
+	}
+
+	message := work.Message
+	if len(message.Title) > 0 {
+		apiResponse.Title = message.Title[0]
+	}
+	apiResponse.Publisher = message.Publisher
+	if len(message.Issued.DateParts) > 0 && len(message.Issued.DateParts[0]) > 0 {
+		apiResponse.Year = message.Issued.DateParts[0][0]
+	}
+	apiResponse.MetadataSource = "crossref"
+	slog.Debug("Looked up DOI in CrossRef", "doi", apiResponse.DOI)
+}
+
+func (client *Client) crossRefWork(ctx context.Context, doi string) (crossRefWork, error) {
+	var work crossRefWork
+
+	release, ok := client.acquire(ctx)
+	if !ok {
+		return work, ErrNotAttempted
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.CrossRefURL+doi, nil)
+	if err != nil {
+		return work, err
+	}
+	// CrossRef sends requests with a mailto in the User-Agent to its
+	// "polite" pool.
+	req.Header.Set("User-Agent", client.userAgent())
+
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		return work, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return work, fmt.Errorf("CrossRef returned %s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&work)
+	if err != nil {
+		return work, err
+	}
+	if len(work.Message.Title) == 0 && work.Message.Publisher == "" {
+		return work, errors.New("CrossRef returned no metadata")
+	}
+	return work, nil
+}
@@ -0,0 +1,49 @@
+package oadoi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Values of APIResponse.GETErrorCategory, which sort GET errors by what went
+// wrong, for the "API - GET Error Category" column and the summary.
+const (
+	GETErrorDNS               string = "dns"
+	GETErrorConnectionRefused string = "connection-refused"
+	GETErrorTimeout           string = "timeout"
+	GETErrorTLS               string = "tls"
+	GETErrorOther             string = "other"
+)
+
+// classifyGETError returns the category of an error making a request.
+func classifyGETError(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return GETErrorTimeout
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return GETErrorDNS
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return GETErrorConnectionRefused
+	}
+
+	var recordHeaderErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &recordHeaderErr) || errors.As(err, &alertErr) || errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return GETErrorTLS
+	}
+
+	return GETErrorOther
+}
@@ -0,0 +1,56 @@
+package oadoi
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// checkBestOAURL requests the best OA location of apiResponse with HEAD and
+// records the final status, after redirects, in BestOAURLStatus, or the
+// error if there was no response. Servers that don't allow HEAD are asked
+// with GET instead, without reading the body.
+func (client *Client) checkBestOAURL(ctx context.Context, apiResponse *APIResponse) {
+	url := apiResponse.BestOaLocation.URL
+	if url == "" {
+		return
+	}
+
+	status, err := client.urlStatus(ctx, http.MethodHead, url)
+	if err == nil && (status.StatusCode == http.StatusMethodNotAllowed || status.StatusCode == http.StatusNotImplemented) {
+		status, err = client.urlStatus(ctx, http.MethodGet, url)
+	}
+	if err == ErrNotAttempted {
+		return
+	}
+	if err != nil {
+		apiResponse.BestOAURLStatus = err.Error()
+	} else {
+		apiResponse.BestOAURLStatus = status.Status
+	}
+	slog.Debug("Checked best OA URL", "doi", apiResponse.DOI, "url", url, "status", apiResponse.BestOAURLStatus)
+}
+
+func (client *Client) urlStatus(ctx context.Context, method string, url string) (*http.Response, error) {
+	release, ok := client.acquire(ctx)
+	if !ok {
+		return nil, ErrNotAttempted
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", client.userAgent())
+
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
@@ -0,0 +1,159 @@
+package oadoi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// InputFormats are the export formats accepted by NewLineReader: one JSON
+// publication per line, or a single JSON array of publications.
+var InputFormats = []string{"ndjson", "array"}
+
+// utf8BOM is the byte order mark that Windows tools put at the start of
+// UTF-8 files.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// A LineReader reads the publications of an export one at a time.
+type LineReader interface {
+	// Next returns the next publication, or false at the end of the export
+	// or after an error.
+	Next() (Line, bool)
+	Err() error
+}
+
+// DefaultMaxLine is the longest ndjson line NewLineReader reads by default.
+// Artudis exports can have very long lines.
+const DefaultMaxLine = 32 * 1024 * 1024
+
+// NewLineReader returns a LineReader for an export named source in one of
+// the InputFormats. The empty format is ndjson. An ndjson line longer than
+// maxLine bytes, or DefaultMaxLine if maxLine is 0, is returned with TooLong
+// set and no Bytes, so that the rest of the export can still be read. A
+// UTF-8 byte order mark at the start of the export is skipped.
+func NewLineReader(format string, source string, r io.Reader, maxLine int) (LineReader, error) {
+	if maxLine <= 0 {
+		maxLine = DefaultMaxLine
+	}
+
+	reader := bufio.NewReaderSize(r, 1024*1024)
+	if bom, _ := reader.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		reader.Discard(len(utf8BOM))
+	}
+
+	switch format {
+	case "", "ndjson":
+		return &ndjsonReader{source: source, reader: reader, maxLine: maxLine}, nil
+	case "array":
+		return &arrayReader{source: source, decoder: json.NewDecoder(reader)}, nil
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+}
+
+type ndjsonReader struct {
+	source  string
+	reader  *bufio.Reader
+	maxLine int
+	err     error
+}
+
+func (n *ndjsonReader) Next() (Line, bool) {
+	if n.err != nil {
+		return Line{}, false
+	}
+
+	// Read the line a buffer at a time, keeping no more than maxLine of it
+	// (plus a line ending), so that one huge line can't use up memory.
+	var line []byte
+	read, tooLong := 0, false
+	for {
+		chunk, err := n.reader.ReadSlice('\n')
+		read += len(chunk)
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(line) > n.maxLine+2 {
+				line, tooLong = nil, true
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && read == 0 {
+			return Line{}, false
+		}
+		if err != nil && err != io.EOF {
+			n.err = err
+			return Line{}, false
+		}
+		break
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if tooLong || len(line) > n.maxLine {
+		return Line{Source: n.source, TooLong: true}, true
+	}
+	if line == nil {
+		line = []byte{}
+	}
+	return Line{Source: n.source, Bytes: line}, true
+}
+
+func (n *ndjsonReader) Err() error {
+	return n.err
+}
+
+// arrayReader decodes the elements of a JSON array one at a time, so the
+// whole export is never in memory. Each element is compacted onto one line,
+// so that dead letter and reject files are still ndjson.
+type arrayReader struct {
+	source  string
+	decoder *json.Decoder
+	started bool
+	err     error
+}
+
+func (a *arrayReader) Next() (Line, bool) {
+	if a.err != nil {
+		return Line{}, false
+	}
+
+	if !a.started {
+		a.started = true
+		token, err := a.decoder.Token()
+		if err == io.EOF {
+			return Line{}, false
+		}
+		if err != nil {
+			a.err = err
+			return Line{}, false
+		}
+		if token != json.Delim('[') {
+			a.err = fmt.Errorf("%s: expected a JSON array, found %v", a.source, token)
+			return Line{}, false
+		}
+	}
+
+	if !a.decoder.More() {
+		return Line{}, false
+	}
+
+	var element json.RawMessage
+	err := a.decoder.Decode(&element)
+	if err != nil {
+		a.err = fmt.Errorf("%s: %v", a.source, err)
+		return Line{}, false
+	}
+
+	var compacted bytes.Buffer
+	json.Compact(&compacted, element)
+	return Line{Source: a.source, Bytes: compacted.Bytes()}, true
+}
+
+func (a *arrayReader) Err() error {
+	return a.err
+}
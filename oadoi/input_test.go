@@ -0,0 +1,105 @@
+package oadoi
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineReader(t *testing.T) {
+	testTable := []struct {
+		format   string
+		fileName string
+	}{
+		{"ndjson", "testdata/publications.ndjson"},
+		{"array", "testdata/publications.json"},
+	}
+
+	for _, tt := range testTable {
+		file, err := os.Open(tt.fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		lineReader, err := NewLineReader(tt.format, "test", file, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for line, ok := lineReader.Next(); ok; line, ok = lineReader.Next() {
+			var publication Publication
+			err := json.Unmarshal(line.Bytes, &publication)
+			if err != nil || strings.Contains(string(line.Bytes), "\n") || line.Source != "test" {
+				t.Errorf("%v line %q, %v", tt.format, line.Bytes, err)
+			}
+			ids = append(ids, publication.ID)
+		}
+		if want := []string{"pub1", "pub2"}; lineReader.Err() != nil || !reflect.DeepEqual(ids, want) {
+			t.Errorf("%v reader => %v, %v, want %v", tt.format, ids, lineReader.Err(), want)
+		}
+	}
+}
+
+func TestArrayReaderErrors(t *testing.T) {
+	testTable := []string{
+		`{"__id__": "pub1"}`,
+		`[{"__id__": "pub1"}, {"__id__": `,
+	}
+
+	for _, input := range testTable {
+		lineReader, _ := NewLineReader("array", "test", strings.NewReader(input), 0)
+		for _, ok := lineReader.Next(); ok; _, ok = lineReader.Next() {
+		}
+		if lineReader.Err() == nil {
+			t.Errorf("array reader accepted %q", input)
+		}
+	}
+}
+
+func TestNDJSONReaderMaxLine(t *testing.T) {
+	input := `{"__id__": "pub1"}` + "\r\n" +
+		`{"__id__": "` + strings.Repeat("x", 100) + `"}` + "\n" +
+		"\n" +
+		`{"__id__": "pub4"}`
+
+	lineReader, _ := NewLineReader("ndjson", "test", strings.NewReader(input), 20)
+	var lines []string
+	for line, ok := lineReader.Next(); ok; line, ok = lineReader.Next() {
+		if line.TooLong {
+			lines = append(lines, "too long")
+		} else {
+			lines = append(lines, string(line.Bytes))
+		}
+	}
+
+	want := []string{`{"__id__": "pub1"}`, "too long", "", `{"__id__": "pub4"}`}
+	if lineReader.Err() != nil || !reflect.DeepEqual(lines, want) {
+		t.Errorf("ndjson reader with a maximum of 20 bytes => %q, %v, want %q", lines, lineReader.Err(), want)
+	}
+}
+
+func TestLineReaderBOM(t *testing.T) {
+	testTable := []struct {
+		format string
+		input  string
+		want   string
+	}{
+		{"ndjson", "\ufeff" + `{"__id__": "pub1"}`, `{"__id__": "pub1"}`},
+		{"array", "\ufeff" + `[{"__id__": "pub1"}]`, `{"__id__":"pub1"}`},
+	}
+
+	for _, tt := range testTable {
+		lineReader, _ := NewLineReader(tt.format, "test", strings.NewReader(tt.input), 0)
+		var lines []string
+		for line, ok := lineReader.Next(); ok; line, ok = lineReader.Next() {
+			lines = append(lines, string(line.Bytes))
+		}
+		if want := []string{tt.want}; lineReader.Err() != nil || !reflect.DeepEqual(lines, want) {
+			t.Errorf("%v reader of %q => %q, %v, want %q", tt.format, tt.input, lines, lineReader.Err(), want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package oadoi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// A Ledger records the DOIs a run has looked up, so that a run that stopped
+// part way can be resumed without looking them up again. It is a file of
+// one JSON entry per line, appended to as lookups complete; each entry is
+// written straight to the file, so a crash loses at most the line being
+// written.
+type Ledger struct {
+	mutex     sync.Mutex
+	file      *os.File
+	responses map[string]APIResponse
+}
+
+type ledgerEntry struct {
+	DOI      string      `json:"doi"`
+	Response APIResponse `json:"response"`
+}
+
+// OpenLedger reads the entries of a ledger, if it exists, and opens it to
+// add more. A line that can't be read, such as one cut short by a crash, is
+// skipped.
+func OpenLedger(fileName string) (*Ledger, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ledger := &Ledger{file: file, responses: map[string]APIResponse{}}
+	reader := bufio.NewReader(file)
+	lineNumber := 0
+	endsWithNewline := true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			lineNumber++
+			endsWithNewline = line[len(line)-1] == '\n'
+
+			var entry ledgerEntry
+			if json.Unmarshal(line, &entry) == nil && entry.DOI != "" {
+				ledger.responses[entry.DOI] = entry.Response
+			} else {
+				slog.Warn("Skipping unreadable ledger entry.", "file", fileName, "line", lineNumber)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+
+	// Start new entries on a line of their own after a partial one.
+	if !endsWithNewline {
+		_, err := file.Write([]byte("\n"))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return ledger, nil
+}
+
+// Len is the number of DOIs read from the ledger when it was opened.
+func (ledger *Ledger) Len() int {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	return len(ledger.responses)
+}
+
+func (ledger *Ledger) lookup(doi string) (APIResponse, bool) {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	apiResponse, ok := ledger.responses[NormalizeDOI(doi)]
+	return apiResponse, ok
+}
+
+func (ledger *Ledger) add(doi string, apiResponse APIResponse) error {
+	entry := ledgerEntry{DOI: NormalizeDOI(doi), Response: apiResponse}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Only entries from earlier runs are kept in memory; within a run,
+	// Dedupe is what saves repeated lookups.
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	_, err = ledger.file.Write(append(data, '\n'))
+	return err
+}
+
+func (ledger *Ledger) Close() error {
+	return ledger.file.Close()
+}
@@ -0,0 +1,148 @@
+package oadoi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics counts the requests a Client makes to oaDOI, and serves them,
+// with the counts in Progress, in the Prometheus text format. The zero
+// Metrics is ready to use, and it is safe to use from several goroutines.
+type Metrics struct {
+	// Progress, if set, adds the records processed and lookups done.
+	Progress *Progress
+
+	mutex sync.Mutex
+	// requests counts requests by the Status of their response.
+	requests map[string]int64
+	// requestLatency times each request, and lookupLatency each lookup
+	// from oaDOI, including retries and the waits between them.
+	requestLatency histogram
+	lookupLatency  histogram
+	retries        int64
+}
+
+func (metrics *Metrics) observeRequest(status string, latency time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	if metrics.requests == nil {
+		metrics.requests = map[string]int64{}
+	}
+	metrics.requests[status]++
+	metrics.requestLatency.observe(latency)
+}
+
+func (metrics *Metrics) observeLookup(attempts int, latency time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.retries += int64(attempts - 1)
+	metrics.lookupLatency.observe(latency)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (metrics *Metrics) WriteTo(w io.Writer) (int64, error) {
+	writer := &countingWriter{w: w}
+
+	metrics.mutex.Lock()
+	statuses := make([]string, 0, len(metrics.requests))
+	for status := range metrics.requests {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	fmt.Fprintln(writer, "# HELP oadoi_requests_total Requests made to oaDOI, by the status of the response.")
+	fmt.Fprintln(writer, "# TYPE oadoi_requests_total counter")
+	for _, status := range statuses {
+		fmt.Fprintf(writer, "oadoi_requests_total{status=%q} %d\n", status, metrics.requests[status])
+	}
+	fmt.Fprintln(writer, "# HELP oadoi_retries_total Requests to oaDOI that repeated an earlier one.")
+	fmt.Fprintln(writer, "# TYPE oadoi_retries_total counter")
+	fmt.Fprintf(writer, "oadoi_retries_total %d\n", metrics.retries)
+	metrics.requestLatency.writeTo(writer, "oadoi_request_duration_seconds", "Time taken by requests to oaDOI.")
+	metrics.lookupLatency.writeTo(writer, "oadoi_lookup_duration_seconds", "Time taken to look up DOIs in oaDOI, including retries.")
+	metrics.mutex.Unlock()
+
+	if metrics.Progress != nil {
+		fmt.Fprintln(writer, "# HELP oadoi_records_processed_total Records written to the report.")
+		fmt.Fprintln(writer, "# TYPE oadoi_records_processed_total counter")
+		fmt.Fprintf(writer, "oadoi_records_processed_total %d\n", metrics.Progress.RecordsDone.Load())
+		fmt.Fprintln(writer, "# HELP oadoi_lookups_total DOI lookups completed, including cached ones.")
+		fmt.Fprintln(writer, "# TYPE oadoi_lookups_total counter")
+		fmt.Fprintf(writer, "oadoi_lookups_total %d\n", metrics.Progress.Lookups.Load())
+		fmt.Fprintln(writer, "# HELP oadoi_record_errors_total Records with a failed lookup.")
+		fmt.Fprintln(writer, "# TYPE oadoi_record_errors_total counter")
+		fmt.Fprintf(writer, "oadoi_record_errors_total %d\n", metrics.Progress.Errors.Load())
+	}
+
+	return writer.n, writer.err
+}
+
+// histogram counts durations by the first of latencyBuckets they fit in,
+// with one more bucket for those slower than the last. Its zero value is
+// ready to use.
+type histogram struct {
+	buckets []int64
+	sum     float64
+}
+
+func (h *histogram) observe(latency time.Duration) {
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(latencyBuckets)+1)
+	}
+	seconds := latency.Seconds()
+	h.sum += seconds
+	h.buckets[sort.SearchFloat64s(latencyBuckets, seconds)]++
+}
+
+func (h *histogram) writeTo(w io.Writer, name string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var count int64
+	for i, bound := range latencyBuckets {
+		if h.buckets != nil {
+			count += h.buckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'f', -1, 64), count)
+	}
+	if h.buckets != nil {
+		count += h.buckets[len(latencyBuckets)]
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape.
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(w)
+}
+
+// countingWriter counts what is written through it and keeps the first
+// error, so that a run of writes can be checked once at the end.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
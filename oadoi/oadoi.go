@@ -0,0 +1,616 @@
+// Package oadoi looks up Artudis publications in the oaDOI API and reports
+// on their open access status.
+package oadoi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Record struct {
+	Publication
+	// SourceFile is the name of the export the record was read from.
+	SourceFile   string
+	APIResponses []APIResponse
+	Line         int             `json:"-"`
+	Raw          json.RawMessage `json:"-"`
+	omitted      bool
+	// rejected is set, along with omitted, when the line isn't valid JSON.
+	rejected bool
+	// skippedOA and skippedType are set, along with omitted, for records
+	// left out by SkipOA and Types.
+	skippedOA   bool
+	skippedType bool
+	// skippedLine is set, along with omitted, for blank and comment lines.
+	skippedLine bool
+	// panicked is set, along with omitted, when processing the line
+	// panicked and RecoverPanics recovered.
+	panicked bool
+	// lookupsSaved counts the DOIs of this record that were not looked up
+	// because they duplicated another.
+	lookupsSaved int
+}
+
+type Publication struct {
+	Identifier        []Identifier `json:"identifier"`
+	IdentifierVariant string       `json:"-"`
+	ID                string       `json:"__id__"`
+	Type              string       `json:"type"`
+	Attachment        []struct {
+		OpenAccess  JSONBool   `json:"open_access"`
+		BlobKey     string     `json:"blob_key"`
+		ExternalURL JSONString `json:"external_url"`
+		Type        string     `json:"type"`
+	} `json:"attachment"`
+}
+
+// JSONBool is a boolean that exports write either as a JSON boolean or as
+// a string: older exports use "true" and "false", and some use "1" and "0".
+// null and the empty string are false.
+type JSONBool bool
+
+func (b *JSONBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case nil:
+		*b = false
+	case bool:
+		*b = JSONBool(value)
+	case string:
+		if value == "" {
+			*b = false
+			return nil
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*b = JSONBool(parsed)
+	default:
+		return fmt.Errorf("%s is not a boolean", data)
+	}
+	return nil
+}
+
+// JSONString is a string that exports may also write as null. Values of
+// other types are ignored, as if they were null, rather than rejecting the
+// line.
+type JSONString string
+
+func (s *JSONString) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	str, _ := value.(string)
+	*s = JSONString(strings.TrimSpace(str))
+	return nil
+}
+
+// KnownSchemes are the identifier schemes found in Artudis exports.
+var KnownSchemes = []string{"doi", "handle", "isbn", "issn", "pmid", "pmcid", "arxiv", "url"}
+
+type Identifier struct {
+	Scheme string `json:"scheme"`
+	Value  string `json:"value"`
+}
+
+// IsDOI reports whether the identifier is a DOI. Older exports spell the
+// scheme DOI or Doi.
+func (identifier Identifier) IsDOI() bool {
+	return strings.EqualFold(identifier.Scheme, "doi")
+}
+
+type APIResponse struct {
+	// Scheme and DOI are the publication identifier that was looked up, as
+	// it is in the export.
+	Scheme     string
+	DOI        string
+	HTTPStatus string
+	// HTTPStatusCode is the numeric code of HTTPStatus, or 0 if no
+	// response was received.
+	HTTPStatusCode int
+	APIResponseBody
+	JSONDecodeError string
+	GETError        string
+	// GETErrorCategory is one of the GETError categories, such as
+	// GETErrorDNS, if GETError is set.
+	GETErrorCategory string
+	// ErrorBody is the start of the body of a non-2xx response, which is
+	// not decoded, or of a body that couldn't be decoded.
+	ErrorBody string
+	Timeout   bool
+	Skipped   bool
+	// MetadataSource is where the title, publisher and year came from:
+	// "crossref" if oaDOI had no record and CrossRef filled them in, and
+	// empty otherwise.
+	MetadataSource string
+	// QuotaExceeded is set if the DOI wasn't looked up because the client
+	// had made its MaxRequests.
+	QuotaExceeded bool
+	// FromSnapshot is set if the response came from a Snapshot rather than
+	// the API. A DOI missing from the snapshot has an empty body.
+	FromSnapshot bool
+	// BestOAURLStatus is the status of a request for the best OA location,
+	// such as "200 OK", or the error if there was no response. It is only
+	// set by a Client with HeadCheck.
+	BestOAURLStatus string
+	// EmptyResponse is set if oaDOI answered with a body that decoded to
+	// no record, such as {}; the lookup is a decode error.
+	EmptyResponse bool
+	// DOIsChecked is the number of DOIs whose responses were combined into
+	// this one by aggregateResponses, and 0 for a response to one DOI.
+	DOIsChecked int
+	// QueriedAt is when oaDOI was asked, which for a cached response is
+	// when it was first fetched.
+	QueriedAt    time.Time
+	retryAfter   time.Duration
+	notAttempted bool
+	bodyTooLarge bool
+}
+
+// OaLocation is a place where oaDOI found an open access copy.
+type OaLocation struct {
+	Evidence          string `json:"evidence"`
+	HostType          string `json:"host_type"`
+	ID                string `json:"id"`
+	License           string `json:"license"`
+	URL               string `json:"url"`
+	URLForLandingPage string `json:"url_for_landing_page"`
+	URLForPdf         string `json:"url_for_pdf"`
+	Version           string `json:"version"`
+}
+
+type APIResponseBody struct {
+	BestOaLocation OaLocation   `json:"best_oa_location"`
+	DataStandard   int          `json:"data_standard"`
+	Doi            string       `json:"doi"`
+	DoiURL         string       `json:"doi_url"`
+	Genre          string       `json:"genre"`
+	IsOa           bool         `json:"is_oa"`
+	JournalIsOa    bool         `json:"journal_is_oa"`
+	JournalIssns   ISSNs        `json:"journal_issns"`
+	JournalIssnL   ISSNs        `json:"journal_issn_l"`
+	JournalName    string       `json:"journal_name"`
+	OaLocations    []OaLocation `json:"oa_locations"`
+	OaStatus       string       `json:"oa_status"`
+	// PublishedDate and Updated are as oaDOI gives them; see PublishedTime
+	// and UpdatedTime.
+	PublishedDate string `json:"published_date"`
+	Publisher     string `json:"publisher"`
+	Title         string `json:"title"`
+	Updated       string `json:"updated"`
+	Year          int    `json:"year"`
+	// ZAuthors are the authors oaDOI has for the DOI, in order.
+	ZAuthors Authors `json:"z_authors"`
+}
+
+// An Author is one of the z_authors of an oaDOI record. Most have a family
+// and given name, from CrossRef; others, such as consortia, only a name.
+type Author struct {
+	Family string `json:"family,omitempty"`
+	Given  string `json:"given,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// Authors decodes the z_authors of an oaDOI record, whose shape varies:
+// authors may be objects with family, given, name or raw_author_name keys,
+// with values that aren't always strings, or plain strings. Anything else,
+// including a z_authors that isn't a list, is ignored rather than failing the
+// whole response.
+type Authors []Author
+
+func (authors *Authors) UnmarshalJSON(data []byte) error {
+	*authors = nil
+
+	var rawAuthors []json.RawMessage
+	if json.Unmarshal(data, &rawAuthors) != nil {
+		return nil
+	}
+
+	for _, rawAuthor := range rawAuthors {
+		if string(rawAuthor) == "null" {
+			continue
+		}
+		var name string
+		if json.Unmarshal(rawAuthor, &name) == nil {
+			*authors = append(*authors, Author{Name: name})
+			continue
+		}
+
+		var fields map[string]interface{}
+		if json.Unmarshal(rawAuthor, &fields) != nil || fields == nil {
+			continue
+		}
+		text := func(key string) string {
+			value, _ := fields[key].(string)
+			return strings.TrimSpace(value)
+		}
+		author := Author{Family: text("family"), Given: text("given"), Name: text("name")}
+		if author.Name == "" {
+			author.Name = text("raw_author_name")
+		}
+		*authors = append(*authors, author)
+	}
+	return nil
+}
+
+// FirstAuthor is the family name of the first author, or their name if
+// they have no family name, or the empty string if there are no authors.
+func (authors Authors) FirstAuthor() string {
+	if len(authors) == 0 {
+		return ""
+	}
+	if authors[0].Family != "" {
+		return authors[0].Family
+	}
+	return authors[0].Name
+}
+
+// apiDateLayouts are the formats oaDOI has been seen to use for dates:
+// published_date is a day, and updated a timestamp with microseconds and
+// no time zone.
+var apiDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// parseAPIDate parses a date in one of apiDateLayouts, taking dates without a
+// time zone to be UTC. It returns the zero time if s is empty or in none of
+// them.
+func parseAPIDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range apiDateLayouts {
+		t, err := time.ParseInLocation(layout, s, time.UTC)
+		if err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// PublishedTime is PublishedDate as a time, or the zero time if it is empty
+// or malformed.
+func (body APIResponseBody) PublishedTime() time.Time {
+	return parseAPIDate(body.PublishedDate)
+}
+
+// UpdatedTime is Updated as a time, or the zero time if it is empty or
+// malformed.
+func (body APIResponseBody) UpdatedTime() time.Time {
+	return parseAPIDate(body.Updated)
+}
+
+// Shapes of the identifier list seen in Artudis exports. Older exports use
+// the plural key, a scheme-to-value object, or a bare top-level doi.
+const (
+	IdentifierVariantCanonical    string = "identifier"
+	IdentifierVariantPlural       string = "identifiers"
+	IdentifierVariantObject       string = "identifier object"
+	IdentifierVariantDOIField     string = "doi field"
+	IdentifierVariantNone         string = "none"
+	IdentifierVariantUnrecognized string = "unrecognized"
+)
+
+// Values of the "API - Status" column. The set is closed so that downstream
+// automation can filter on it without parsing the detailed error columns;
+// the README lists it too, and a value added here belongs there.
+const (
+	// StatusOK is a record from oaDOI.
+	StatusOK string = "ok"
+	// StatusNotFound is a 404, or a DOI missing from the Snapshot.
+	StatusNotFound string = "not-found"
+	// StatusAPIError is any other error status from oaDOI.
+	StatusAPIError string = "api-error"
+	// StatusDecodeError is a response body that wasn't a record.
+	StatusDecodeError string = "decode-error"
+	// StatusNetworkError is a request that got no response.
+	StatusNetworkError string = "network-error"
+	// StatusTimeout is a request that took longer than Client.Timeout.
+	StatusTimeout string = "timeout"
+	// StatusInvalidDOI is an identifier that doesn't start with 10.
+	StatusInvalidDOI string = "invalid-doi"
+	// StatusNoDOI is a publication with no identifier to look up.
+	StatusNoDOI string = "no-doi"
+	// StatusSkipped is a DOI not looked up by choice, as with DryRun.
+	StatusSkipped string = "skipped"
+	// StatusOverQuota is a DOI not looked up because Client.MaxRequests
+	// had been made. Unlike skipped, it counts as a failed record, so that
+	// the DeadLetter file collects it for a later run.
+	StatusOverQuota string = "quota-exceeded"
+)
+
+var attachmentTypeToWeightMap = map[string]int{
+	"missing":             0,
+	"other":               1,
+	"submittedManuscript": 2,
+	"acceptedManuscript":  3,
+	"finalVersion":        4,
+}
+
+// oaVersionWeights rank the versions of oaDOI locations, as
+// attachmentTypeToWeightMap ranks Artudis attachments.
+var oaVersionWeights = map[string]int{
+	"submittedVersion": 2,
+	"acceptedVersion":  3,
+	"publishedVersion": 4,
+}
+
+// AttachmentWeights returns the default attachment type weights with
+// overrides merged over them. Higher weights are better OA copies.
+func AttachmentWeights(overrides map[string]int) map[string]int {
+	weights := map[string]int{}
+	for attachmentType, weight := range attachmentTypeToWeightMap {
+		weights[attachmentType] = weight
+	}
+	for attachmentType, weight := range overrides {
+		weights[attachmentType] = weight
+	}
+	return weights
+}
+
+// ArtudisOA reports whether Artudis has an open access attachment for the
+// publication, and the type of the best one by weight, or "missing" if there
+// is none. The default weights are used if weights is nil.
+func (publication Publication) ArtudisOA(weights map[string]int) (available bool, bestType string) {
+	if weights == nil {
+		weights = attachmentTypeToWeightMap
+	}
+
+	bestType = "missing"
+	for _, attachment := range publication.Attachment {
+		if attachment.OpenAccess {
+			available = true
+			if weights[attachment.Type] > weights[bestType] {
+				bestType = attachment.Type
+			}
+		}
+	}
+	return available, bestType
+}
+
+// ArtudisExternalURL returns the external URL, such as a link to another
+// repository, of the best open access attachment of the publication by
+// weight, or of the first if none has a known type. It is empty if that
+// attachment is a blob, or there is no open access attachment. The default
+// weights are used if weights is nil.
+func (publication Publication) ArtudisExternalURL(weights map[string]int) string {
+	if weights == nil {
+		weights = attachmentTypeToWeightMap
+	}
+
+	best := -1
+	for i, attachment := range publication.Attachment {
+		if attachment.OpenAccess && (best < 0 || weights[attachment.Type] > weights[publication.Attachment[best].Type]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return string(publication.Attachment[best].ExternalURL)
+}
+
+// LowWeightOA reports whether Artudis has the publication as open access
+// only through attachments weighted no higher than "other", which usually
+// means the attachment is mislabelled. Changing the weights, of "other" or
+// of the other types, changes which publications this flags. The default
+// weights are used if weights is nil.
+func (publication Publication) LowWeightOA(weights map[string]int) bool {
+	if weights == nil {
+		weights = attachmentTypeToWeightMap
+	}
+	available, bestType := publication.ArtudisOA(weights)
+	return available && weights[bestType] <= weights["other"]
+}
+
+func (publication *Publication) UnmarshalJSON(data []byte) error {
+	type plainPublication Publication
+	var raw struct {
+		plainPublication
+		Identifier  json.RawMessage `json:"identifier"`
+		Identifiers json.RawMessage `json:"identifiers"`
+		DOI         json.RawMessage `json:"doi"`
+	}
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	*publication = Publication(raw.plainPublication)
+	publication.Identifier, publication.IdentifierVariant = decodeIdentifiers(raw.Identifier, raw.Identifiers, raw.DOI)
+	return nil
+}
+
+func decodeIdentifiers(identifier, identifiers, doi json.RawMessage) ([]Identifier, string) {
+	if isPresent(identifier) {
+		var list []Identifier
+		if json.Unmarshal(identifier, &list) == nil {
+			return list, IdentifierVariantCanonical
+		}
+		if list, ok := decodeIdentifierObject(identifier); ok {
+			return list, IdentifierVariantObject
+		}
+		return nil, IdentifierVariantUnrecognized
+	}
+
+	if isPresent(identifiers) {
+		var list []Identifier
+		if json.Unmarshal(identifiers, &list) == nil {
+			return list, IdentifierVariantPlural
+		}
+		if list, ok := decodeIdentifierObject(identifiers); ok {
+			return list, IdentifierVariantObject
+		}
+		return nil, IdentifierVariantUnrecognized
+	}
+
+	if isPresent(doi) {
+		var value string
+		if json.Unmarshal(doi, &value) == nil {
+			return []Identifier{{Scheme: "doi", Value: value}}, IdentifierVariantDOIField
+		}
+		return nil, IdentifierVariantUnrecognized
+	}
+
+	return nil, IdentifierVariantNone
+}
+
+// decodeIdentifierObject handles identifiers given as {"doi": "10.x"} or
+// {"doi": ["10.x", "10.y"]}.
+func decodeIdentifierObject(data json.RawMessage) ([]Identifier, bool) {
+	var object map[string]json.RawMessage
+	if json.Unmarshal(data, &object) != nil {
+		return nil, false
+	}
+
+	var list []Identifier
+	for scheme, rawValue := range object {
+		var value string
+		var values []string
+		if json.Unmarshal(rawValue, &value) == nil {
+			values = []string{value}
+		} else if json.Unmarshal(rawValue, &values) != nil {
+			return nil, false
+		}
+		for _, value := range values {
+			list = append(list, Identifier{Scheme: scheme, Value: value})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Scheme != list[j].Scheme {
+			return list[i].Scheme < list[j].Scheme
+		}
+		return list[i].Value < list[j].Value
+	})
+	return list, true
+}
+
+func isPresent(data json.RawMessage) bool {
+	return len(data) > 0 && string(data) != "null"
+}
+
+var doiPrefixes = []string{
+	"doi:",
+	"http://doi.org/",
+	"https://doi.org/",
+	"http://dx.doi.org/",
+	"https://dx.doi.org/",
+	"http://www.doi.org/",
+	"https://www.doi.org/",
+}
+
+// NormalizeDOI reduces the ways a DOI is written in Artudis exports to the
+// bare, lowercased 10.x/y form oaDOI expects. DOIs are case-insensitive, so
+// this is the form used to compare them, for deduplication, caches and
+// ledgers, whatever the case policy of the report.
+func NormalizeDOI(raw string) string {
+	return strings.ToLower(TrimDOI(raw))
+}
+
+// TrimDOI is NormalizeDOI without the lowercasing: it strips the prefix and
+// whitespace but keeps the case of the DOI as it was written, for Clients
+// and reports that PreserveDOICase.
+func TrimDOI(raw string) string {
+	doi := strings.TrimSpace(raw)
+	for _, prefix := range doiPrefixes {
+		if len(doi) >= len(prefix) && strings.EqualFold(doi[:len(prefix)], prefix) {
+			doi = strings.TrimSpace(doi[len(prefix):])
+			break
+		}
+	}
+	return doi
+}
+
+// registrantPrefix is the registrant part of a DOI, such as 10.1038 for
+// 10.1038/nature12373, or the empty string if it doesn't look like a DOI.
+func registrantPrefix(doi string) string {
+	prefix, _, found := strings.Cut(NormalizeDOI(doi), "/")
+	if !found || !strings.HasPrefix(prefix, "10.") {
+		return ""
+	}
+	return prefix
+}
+
+// StatusCode is HTTPStatusCode, or for responses cached without it, the code
+// parsed from the HTTPStatus string. It is 0 if no response was received.
+func (apiresponse APIResponse) StatusCode() int {
+	if apiresponse.HTTPStatusCode != 0 {
+		return apiresponse.HTTPStatusCode
+	}
+	code, _ := strconv.Atoi(strings.SplitN(apiresponse.HTTPStatus, " ", 2)[0])
+	return code
+}
+
+// Status summarises the outcome of the lookup as one of the Status values.
+func (apiresponse APIResponse) Status() string {
+	switch {
+	case apiresponse.Skipped:
+		return StatusSkipped
+	case apiresponse.QuotaExceeded:
+		return StatusOverQuota
+	case apiresponse.DOI == "":
+		return StatusNoDOI
+	case !strings.HasPrefix(NormalizeDOI(apiresponse.DOI), "10."):
+		return StatusInvalidDOI
+	case apiresponse.Timeout:
+		return StatusTimeout
+	case apiresponse.GETError != "":
+		return StatusNetworkError
+	case apiresponse.FromSnapshot && apiresponse.JSONDecodeError == "" && apiresponse.Doi == "":
+		return StatusNotFound
+	}
+
+	code := apiresponse.StatusCode()
+	switch {
+	case code == http.StatusNotFound:
+		return StatusNotFound
+	case code != 0 && (code < 200 || code > 299):
+		return StatusAPIError
+	case apiresponse.JSONDecodeError != "":
+		return StatusDecodeError
+	}
+
+	return StatusOK
+}
+
+// Errored reports whether the lookup got an error of any kind, including
+// oaDOI answering with a non-2xx status such as 404.
+func (apiresponse APIResponse) Errored() bool {
+	if apiresponse.GETError != "" || apiresponse.JSONDecodeError != "" {
+		return true
+	}
+	code := apiresponse.StatusCode()
+	return apiresponse.HTTPStatus != "" && (code < 200 || code > 299)
+}
+
+// Failed reports whether any lookup for the record failed in a way that is
+// worth retrying later. Not-found and invalid DOIs are answers, not failures.
+func (record Record) Failed() bool {
+	for _, apiresponse := range record.APIResponses {
+		switch apiresponse.Status() {
+		case StatusNetworkError, StatusTimeout, StatusAPIError, StatusDecodeError, StatusOverQuota:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,449 @@
+package oadoi
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMakeSherpaLink(t *testing.T) {
+	testTable := []struct {
+		input  string
+		output string
+	}{
+		{"", ""},
+		{"0028-0836", SHERPAURI + "0028-0836/"},
+		{"00280836", SHERPAURI + "0028-0836/"},
+		{"0028-0836,1476-4687", SHERPAURI + "0028-0836/," + SHERPAURI + "1476-4687/"},
+		{"2049-369x", SHERPAURI + "2049-369X/"},
+		{"0028-0837", ""},
+		{"0028-0836,abcd-efgh", SHERPAURI + "0028-0836/"},
+		{"123,0028-0836", SHERPAURI + "0028-0836/"},
+		{"0028-0836,0028-0836", SHERPAURI + "0028-0836/"},
+		{"0028-0836,00280836", SHERPAURI + "0028-0836/"},
+		{" 1476-4687 , 0028-0836", SHERPAURI + "0028-0836/," + SHERPAURI + "1476-4687/"},
+		{"0028 - 0836", SHERPAURI + "0028-0836/"},
+		{"0028 0836", SHERPAURI + "0028-0836/"},
+		{"0028–0836", SHERPAURI + "0028-0836/"},
+	}
+
+	for _, tt := range testTable {
+		realOutput := MakeSherpaLink(tt.input, SHERPAURI)
+		if realOutput != tt.output {
+			t.Errorf("MakeSherpaLink(%v) => %v, want %v", tt.input, realOutput, tt.output)
+		}
+	}
+
+	baseURL := "https://sherpa.example.com/issn/"
+	if realOutput := MakeSherpaLink("0028-0836", baseURL); realOutput != baseURL+"0028-0836/" {
+		t.Errorf("MakeSherpaLink with base %v => %v, want %v", baseURL, realOutput, baseURL+"0028-0836/")
+	}
+}
+
+func TestMakeSherpaV2Link(t *testing.T) {
+	testTable := []struct {
+		input  string
+		output string
+	}{
+		{"", ""},
+		{"0028-0837", ""},
+		{"00280836", SHERPAV2URI + "?api-key=KEY&filter=%5B%5B%22issn%22%2C%22equals%22%2C%220028-0836%22%5D%5D&format=Json&item-type=publication"},
+	}
+
+	for _, tt := range testTable {
+		realOutput := MakeSherpaV2Link(tt.input, "KEY", SHERPAV2URI)
+		if realOutput != tt.output {
+			t.Errorf("MakeSherpaV2Link(%v) => %v, want %v", tt.input, realOutput, tt.output)
+		}
+	}
+}
+
+func TestAPIResponseStatus(t *testing.T) {
+	testTable := []struct {
+		input  APIResponse
+		output string
+	}{
+		{APIResponse{DOI: "10.1234/abc", HTTPStatus: "200 OK"}, StatusOK},
+		{APIResponse{DOI: "http://dx.doi.org/10.1234/abc", HTTPStatus: "200 OK"}, StatusOK},
+		{APIResponse{DOI: "10.1234/abc", HTTPStatus: "404 Not Found", JSONDecodeError: "bad json"}, StatusNotFound},
+		{APIResponse{DOI: "10.1234/abc", HTTPStatus: "422 Unprocessable Entity"}, StatusAPIError},
+		{APIResponse{DOI: "10.1234/abc", HTTPStatus: "503 Service Unavailable"}, StatusAPIError},
+		{APIResponse{DOI: "10.1234/abc", HTTPStatus: "200 OK", JSONDecodeError: "unexpected EOF"}, StatusDecodeError},
+		{APIResponse{DOI: "10.1234/abc", GETError: "connection refused"}, StatusNetworkError},
+		{APIResponse{DOI: "10.1234/abc", GETError: "i/o timeout", Timeout: true}, StatusTimeout},
+		{APIResponse{DOI: "not a doi", HTTPStatus: "404 Not Found"}, StatusInvalidDOI},
+		{APIResponse{}, StatusNoDOI},
+		{APIResponse{DOI: "10.1234/abc", Skipped: true}, StatusSkipped},
+	}
+
+	for _, tt := range testTable {
+		realOutput := tt.input.Status()
+		if realOutput != tt.output {
+			t.Errorf("%+v.Status() => %v, want %v", tt.input, realOutput, tt.output)
+		}
+	}
+}
+
+func TestPublicationIdentifierVariants(t *testing.T) {
+	testTable := []struct {
+		input       string
+		identifiers []Identifier
+		variant     string
+	}{
+		{`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1/a"}]}`, []Identifier{{"doi", "10.1/a"}}, IdentifierVariantCanonical},
+		{`{"__id__": "1", "identifiers": [{"scheme": "doi", "value": "10.1/a"}]}`, []Identifier{{"doi", "10.1/a"}}, IdentifierVariantPlural},
+		{`{"__id__": "1", "identifier": {"doi": "10.1/a", "isbn": ["1", "2"]}}`, []Identifier{{"doi", "10.1/a"}, {"isbn", "1"}, {"isbn", "2"}}, IdentifierVariantObject},
+		{`{"__id__": "1", "doi": "10.1/a"}`, []Identifier{{"doi", "10.1/a"}}, IdentifierVariantDOIField},
+		{`{"__id__": "1"}`, nil, IdentifierVariantNone},
+		{`{"__id__": "1", "identifier": "10.1/a"}`, nil, IdentifierVariantUnrecognized},
+	}
+
+	for _, tt := range testTable {
+		var publication Publication
+		err := json.Unmarshal([]byte(tt.input), &publication)
+		if err != nil {
+			t.Errorf("json.Unmarshal(%v) => error %v", tt.input, err)
+			continue
+		}
+		if publication.ID != "1" {
+			t.Errorf("json.Unmarshal(%v) => ID %v, want 1", tt.input, publication.ID)
+		}
+		if !reflect.DeepEqual(publication.Identifier, tt.identifiers) || publication.IdentifierVariant != tt.variant {
+			t.Errorf("json.Unmarshal(%v) => %v %v, want %v %v", tt.input, publication.Identifier, publication.IdentifierVariant, tt.identifiers, tt.variant)
+		}
+	}
+}
+
+func TestArtudisOA(t *testing.T) {
+	var publication Publication
+	json.Unmarshal([]byte(`{"attachment": [
+		{"open_access": "true", "type": "submittedManuscript"},
+		{"open_access": "true", "type": "publishedVersion"},
+		{"open_access": "false", "type": "finalVersion"}
+	]}`), &publication)
+
+	testTable := []struct {
+		weights   map[string]int
+		available bool
+		bestType  string
+	}{
+		{nil, true, "submittedManuscript"},
+		{AttachmentWeights(map[string]int{"publishedVersion": 4}), true, "publishedVersion"},
+		{AttachmentWeights(map[string]int{"submittedManuscript": 0}), true, "missing"},
+	}
+
+	for _, tt := range testTable {
+		available, bestType := publication.ArtudisOA(tt.weights)
+		if available != tt.available || bestType != tt.bestType {
+			t.Errorf("ArtudisOA(%v) => %v, %v, want %v, %v", tt.weights, available, bestType, tt.available, tt.bestType)
+		}
+	}
+}
+
+func TestLowWeightOA(t *testing.T) {
+	testTable := []struct {
+		input   string
+		weights map[string]int
+		output  bool
+	}{
+		{`{"attachment": [{"open_access": "true", "type": "other"}]}`, nil, true},
+		{`{"attachment": [{"open_access": "true", "type": "unknownType"}]}`, nil, true},
+		{`{"attachment": [{"open_access": "true", "type": "other"}, {"open_access": "true", "type": "acceptedManuscript"}]}`, nil, false},
+		{`{"attachment": [{"open_access": "true", "type": "other"}, {"open_access": "false", "type": "finalVersion"}]}`, nil, true},
+		{`{"attachment": [{"open_access": "false", "type": "other"}]}`, nil, false},
+		{`{"attachment": [{"open_access": "true", "type": "submittedManuscript"}]}`, AttachmentWeights(map[string]int{"other": 2}), true},
+		{`{"attachment": [{"open_access": "true", "type": "other"}]}`, AttachmentWeights(map[string]int{"other": -1}), false},
+	}
+
+	for _, tt := range testTable {
+		var publication Publication
+		json.Unmarshal([]byte(tt.input), &publication)
+		realOutput := publication.LowWeightOA(tt.weights)
+		if realOutput != tt.output {
+			t.Errorf("LowWeightOA(%s, %v) => %v, want %v", tt.input, tt.weights, realOutput, tt.output)
+		}
+	}
+}
+
+func TestArtudisOAOpenAccessForms(t *testing.T) {
+	data, err := os.ReadFile("testdata/open_access.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		"string-true":  true,
+		"string-false": false,
+		"bool-true":    true,
+		"bool-false":   false,
+		"string-1":     true,
+		"string-0":     false,
+		"null":         false,
+		"missing":      false,
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var publication Publication
+		err := json.Unmarshal([]byte(line), &publication)
+		available, _ := publication.ArtudisOA(nil)
+		if err != nil || available != want[publication.ID] {
+			t.Errorf("ArtudisOA of %s => %v, %v, want %v", line, available, err, want[publication.ID])
+		}
+	}
+}
+
+func TestArtudisExternalURL(t *testing.T) {
+	data, err := os.ReadFile("testdata/external_url.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"string":       "https://repository.example.org/1234",
+		"null":         "",
+		"missing":      "",
+		"object":       "",
+		"not-oa":       "",
+		"best-weight":  "https://repository.example.org/final",
+		"best-is-blob": "",
+		"unknown-type": "https://repository.example.org/1234",
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var publication Publication
+		err := json.Unmarshal([]byte(line), &publication)
+		externalURL := publication.ArtudisExternalURL(nil)
+		if err != nil || externalURL != want[publication.ID] {
+			t.Errorf("ArtudisExternalURL of %s => %q, %v, want %q", line, externalURL, err, want[publication.ID])
+		}
+	}
+}
+
+func TestJSONBoolErrors(t *testing.T) {
+	for _, input := range []string{`"yes"`, `2`, `{}`} {
+		var b JSONBool
+		if json.Unmarshal([]byte(input), &b) == nil {
+			t.Errorf("json.Unmarshal(%s) into a JSONBool => no error", input)
+		}
+	}
+}
+
+func TestISSNs(t *testing.T) {
+	data, err := os.ReadFile("testdata/journal_issns.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][3]string{
+		"10.1/usual":            {"0028-0836,1476-4687", "0028-0836", "0028-0836,1476-4687"},
+		"10.1/spaces":           {"0028-0836,1476-4687", "", "0028-0836,1476-4687"},
+		"10.1/no-hyphen":        {"0028-0836", "", "0028-0836"},
+		"10.1/semicolons":       {"0028-0836,1476-4687", "", "0028-0836,1476-4687"},
+		"10.1/space-separated":  {"0028-0836,1476-4687", "", "0028-0836,1476-4687"},
+		"10.1/en-dash":          {"0028-0836", "", "0028-0836"},
+		"10.1/number":           {"0028-0836", "0028-0836", "0028-0836"},
+		"10.1/array":            {"0028-0836,1476-4687", "", "0028-0836,1476-4687"},
+		"10.1/array-of-numbers": {"0028-0836,1476-4687", "", "0028-0836,1476-4687"},
+		"10.1/lowercase-x":      {"2049-369X", "", "2049-369X"},
+		"10.1/invalid":          {"", "", ""},
+		"10.1/null":             {"", "", ""},
+		"10.1/missing":          {"", "", ""},
+		"10.1/issn-l-only":      {"", "1476-4687", "1476-4687"},
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var body APIResponseBody
+		err := json.Unmarshal([]byte(line), &body)
+		got := [3]string{string(body.JournalIssns), string(body.JournalIssnL), body.sherpaISSNs()}
+		if err != nil || got != want[body.Doi] {
+			t.Errorf("ISSNs of %s => %q, %v, want %q", line, got, err, want[body.Doi])
+		}
+	}
+
+	// The canonical form survives the cache.
+	var body APIResponseBody
+	json.Unmarshal([]byte(`{"journal_issns": "0028 0836; 1476-4687"}`), &body)
+	encoded, _ := json.Marshal(body)
+	var decoded APIResponseBody
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil || decoded.JournalIssns != body.JournalIssns {
+		t.Errorf("ISSNs after a round trip => %q, %v, want %q", decoded.JournalIssns, err, body.JournalIssns)
+	}
+}
+
+func TestAuthors(t *testing.T) {
+	testTable := []struct {
+		input       string
+		count       int
+		firstAuthor string
+	}{
+		{`{"z_authors": [{"given": "Ada", "family": "Lovelace", "sequence": "first"}, {"family": "Babbage"}]}`, 2, "Lovelace"},
+		{`{"z_authors": [{"name": "The Consortium", "affiliation": [{"name": "Somewhere"}]}]}`, 1, "The Consortium"},
+		{`{"z_authors": [{"raw_author_name": "A. Lovelace"}]}`, 1, "A. Lovelace"},
+		{`{"z_authors": [{"family": 42, "given": "Ada"}]}`, 1, ""},
+		{`{"z_authors": ["Ada Lovelace", null, 3]}`, 1, "Ada Lovelace"},
+		{`{"z_authors": {"family": "Lovelace"}}`, 0, ""},
+		{`{"z_authors": []}`, 0, ""},
+		{`{"z_authors": null}`, 0, ""},
+		{`{}`, 0, ""},
+	}
+
+	for _, tt := range testTable {
+		var body APIResponseBody
+		err := json.Unmarshal([]byte(tt.input), &body)
+		if err != nil || len(body.ZAuthors) != tt.count || body.ZAuthors.FirstAuthor() != tt.firstAuthor {
+			t.Errorf("json.Unmarshal(%s) => %d authors, first %q, %v, want %d, first %q",
+				tt.input, len(body.ZAuthors), body.ZAuthors.FirstAuthor(), err, tt.count, tt.firstAuthor)
+		}
+
+		// Cached responses are decoded from what was encoded.
+		encoded, _ := json.Marshal(body)
+		var decoded APIResponseBody
+		err = json.Unmarshal(encoded, &decoded)
+		if err != nil || !reflect.DeepEqual(decoded.ZAuthors, body.ZAuthors) {
+			t.Errorf("json.Unmarshal(%s) => %v, %v, want %v", encoded, decoded.ZAuthors, err, body.ZAuthors)
+		}
+	}
+}
+
+func TestNormalizeDOI(t *testing.T) {
+	testTable := []struct {
+		input  string
+		output string
+	}{
+		{"10.1234/abc", "10.1234/abc"},
+		{"10.1234/ABC.Def", "10.1234/abc.def"},
+		{"  10.1234/abc\n", "10.1234/abc"},
+		{"doi:10.1234/abc", "10.1234/abc"},
+		{"DOI: 10.1234/abc", "10.1234/abc"},
+		{"http://dx.doi.org/10.1234/abc", "10.1234/abc"},
+		{"https://dx.doi.org/10.1234/abc", "10.1234/abc"},
+		{"http://doi.org/10.1234/abc", "10.1234/abc"},
+		{"https://doi.org/10.1234/abc", "10.1234/abc"},
+		{"https://www.doi.org/10.1234/abc", "10.1234/abc"},
+		{"HTTPS://DOI.ORG/10.1234/ABC", "10.1234/abc"},
+		{"", ""},
+	}
+
+	for _, tt := range testTable {
+		realOutput := NormalizeDOI(tt.input)
+		if realOutput != tt.output {
+			t.Errorf("NormalizeDOI(%q) => %q, want %q", tt.input, realOutput, tt.output)
+		}
+	}
+}
+
+func TestTrimDOI(t *testing.T) {
+	testTable := []struct {
+		input  string
+		output string
+	}{
+		{"10.1234/ABC.Def", "10.1234/ABC.Def"},
+		{"  10.1234/Abc\n", "10.1234/Abc"},
+		{"DOI: 10.1234/Abc", "10.1234/Abc"},
+		{"HTTPS://DOI.ORG/10.1234/ABC", "10.1234/ABC"},
+		{"https://dx.doi.org/10.1234/Abc", "10.1234/Abc"},
+		{"doi", "doi"},
+		{"", ""},
+	}
+
+	for _, tt := range testTable {
+		realOutput := TrimDOI(tt.input)
+		if realOutput != tt.output {
+			t.Errorf("TrimDOI(%q) => %q, want %q", tt.input, realOutput, tt.output)
+		}
+	}
+}
+
+func TestRegistrantPrefix(t *testing.T) {
+	testTable := []struct {
+		input  string
+		output string
+	}{
+		{"10.1038/nature12373", "10.1038"},
+		{"https://doi.org/10.1038/Nature12373", "10.1038"},
+		{"10.1000.10/abc/def", "10.1000.10"},
+		{"10.1234", ""},
+		{"not a doi/abc", ""},
+		{"", ""},
+	}
+
+	for _, tt := range testTable {
+		realOutput := registrantPrefix(tt.input)
+		if realOutput != tt.output {
+			t.Errorf("registrantPrefix(%q) => %q, want %q", tt.input, realOutput, tt.output)
+		}
+	}
+}
+
+func TestParseAPIDate(t *testing.T) {
+	testTable := []struct {
+		input  string
+		output string
+	}{
+		{"2023-01-20T17:48:42.937869", "2023-01-20T17:48:42Z"},
+		{"2023-01-20T17:48:42", "2023-01-20T17:48:42Z"},
+		{"2023-01-20 17:48:42.937869", "2023-01-20T17:48:42Z"},
+		{"2023-01-20T17:48:42+02:00", "2023-01-20T17:48:42+02:00"},
+		{"2015-03-01", "2015-03-01T00:00:00Z"},
+		{" 2015-03-01 ", "2015-03-01T00:00:00Z"},
+		{"2015-02-30", ""},
+		{"March 2015", ""},
+		{"", ""},
+	}
+
+	for _, tt := range testTable {
+		realOutput := formatTime(parseAPIDate(tt.input))
+		if realOutput != tt.output {
+			t.Errorf("parseAPIDate(%q) => %q, want %q", tt.input, realOutput, tt.output)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	var oaResponse, closedResponse APIResponse
+	oaResponse.DOI, oaResponse.HTTPStatus, oaResponse.IsOa = "10.1/a", "200 OK", true
+	closedResponse.DOI, closedResponse.HTTPStatus = "10.1/b", "200 OK"
+
+	records := []Record{
+		{APIResponses: []APIResponse{oaResponse, closedResponse}},
+		{APIResponses: []APIResponse{{DOI: "10.1/c", GETError: "connection refused", GETErrorCategory: GETErrorConnectionRefused}}},
+		{APIResponses: []APIResponse{{DOI: "10.1/d", HTTPStatus: "200 OK", JSONDecodeError: "unexpected EOF"}}},
+		{APIResponses: []APIResponse{{DOI: "10.1/e", HTTPStatus: "404 Not Found", HTTPStatusCode: 404}}},
+		{},
+		{APIResponses: []APIResponse{oaResponse}, lookupsSaved: 2},
+		{APIResponses: []APIResponse{{DOI: "10.1/f", Skipped: true}}},
+		{APIResponses: []APIResponse{closedResponse}},
+	}
+	json.Unmarshal([]byte(`{"attachment": [{"open_access": "true", "type": "publishedVersion"}]}`), &records[7].Publication)
+
+	var summary Summary
+	for _, record := range records {
+		summary.Add(record)
+	}
+
+	want := Summary{
+		Records:          8,
+		RecordsWithDOI:   7,
+		APIOATrue:        2,
+		APIOAFalse:       2,
+		GETErrors:        1,
+		JSONDecodeErrors: 1,
+		Non200Statuses:   1,
+		LookupsSaved:     2,
+		LookupsSkipped:   1,
+		Succeeded:        5,
+		Failed:           2,
+		ArtudisOATrue:    1,
+		OAMismatches:     3,
+		StatusCodes:      map[int]int{200: 5, 404: 1},
+
+		GETErrorCategories: map[string]int{GETErrorConnectionRefused: 1},
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("Summary => %+v, want %+v", summary, want)
+	}
+
+	if got, want := summary.StatusCodeString(), "200: 5, 404: 1"; got != want {
+		t.Errorf("StatusCodeString() => %q, want %q", got, want)
+	}
+}
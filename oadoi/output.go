@@ -0,0 +1,441 @@
+package oadoi
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// OutputFormats are the formats accepted by NewRecordWriter.
+var OutputFormats = []string{"csv", "tsv", "json", "xlsx", "flatjson"}
+
+// A RecordWriter turns records into one of the supported output formats.
+type RecordWriter interface {
+	WriteHeader() error
+	Write(record Record) error
+	Flush() error
+}
+
+// WriterOptions change what a RecordWriter writes.
+type WriterOptions struct {
+	// AllLocations writes a csv row for every OA location of each DOI
+	// instead of only the best one. DOIs with no locations still get a row.
+	// Closed locations are left out, unless IncludeClosed is set; see
+	// closedLocation.
+	AllLocations  bool
+	IncludeClosed bool
+	// SherpaKey, if set, makes the Sherpa links point at the Sherpa Romeo
+	// v2 API using this key, instead of the legacy pages.
+	SherpaKey string
+	// SherpaURL, if set, replaces SHERPAURI, or SHERPAV2URI if there is a
+	// SherpaKey, as the base of Sherpa links.
+	SherpaURL string
+	// Columns are the keys of the csv columns to write, in order. All of
+	// ColumnKeys are written if it is empty.
+	Columns []string
+	// NoHeader leaves out the csv header row, for appending to a report.
+	NoHeader bool
+	// AttachmentWeights rank attachment types for the best Artudis OA
+	// copy. See AttachmentWeights; the defaults are used if it is nil.
+	AttachmentWeights map[string]int
+	// PreserveDOICase writes the DOI column in the case of the export, as
+	// TrimDOI leaves it, rather than as oaDOI gives it, which is lowercase.
+	PreserveDOICase bool
+	// Baseline, if set, is an earlier report to compare rows with, in the
+	// baseline_change column.
+	Baseline *Baseline
+}
+
+// NewRecordWriter returns a RecordWriter for one of the OutputFormats. The
+// csv format is the original report: one row per DOI looked up. tsv is the
+// same report separated by tabs; values containing a tab, quote or newline
+// are still quoted as they would be in csv. xlsx is the same report as an
+// Excel workbook, which is only complete once Flush is called, so it can't
+// be appended to. flatjson is the same report again with a JSON object per
+// row, keyed by column, instead of a header; see jsonValue.
+func NewRecordWriter(format string, w io.Writer, options WriterOptions) (RecordWriter, error) {
+	switch format {
+	case "csv", "tsv", "xlsx", "flatjson":
+		columns, err := selectColumns(options.Columns)
+		if err != nil {
+			return nil, err
+		}
+		var rows rowWriter
+		switch format {
+		case "csv":
+			rows = csv.NewWriter(w)
+		case "tsv":
+			tsvWriter := csv.NewWriter(w)
+			tsvWriter.Comma = '\t'
+			rows = tsvWriter
+		case "xlsx":
+			rows = newXLSXWriter(w, !options.NoHeader)
+		case "flatjson":
+			rows = &flatJSONWriter{w: w, columns: columns}
+			options.NoHeader = true
+		}
+		return &csvRecordWriter{w: rows, options: options, columns: columns}, nil
+	case "json":
+		return &jsonRecordWriter{encoder: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// A rowWriter writes the rows of a tabular report, as csv.Writer does.
+type rowWriter interface {
+	Write(record []string) error
+	Flush()
+	Error() error
+}
+
+// csvRecordWriter writes the tabular formats: csv, tsv, xlsx and flatjson.
+type csvRecordWriter struct {
+	w       rowWriter
+	options WriterOptions
+	columns []column
+
+	loggedTypes map[string]bool
+}
+
+func (c *csvRecordWriter) WriteHeader() error {
+	if c.options.NoHeader {
+		return nil
+	}
+
+	header := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		header[i] = column.header
+	}
+
+	return c.w.Write(header)
+}
+
+func (c *csvRecordWriter) Write(record Record) error {
+	c.logUnknownTypes(record.Publication)
+	artudisOA, highestLevel := record.Publication.ArtudisOA(c.options.AttachmentWeights)
+
+	// A publication without a DOI still gets a row, with a no-doi status, so
+	// that it is counted.
+	apiresponses := record.APIResponses
+	if len(apiresponses) == 0 {
+		apiresponses = []APIResponse{{}}
+	}
+
+	for _, apiresponse := range apiresponses {
+		best := apiresponse.APIResponseBody.BestOaLocation
+		locations := []OaLocation{best}
+		if c.options.AllLocations && len(apiresponse.APIResponseBody.OaLocations) > 0 {
+			locations = nil
+			for _, location := range apiresponse.APIResponseBody.OaLocations {
+				if c.options.IncludeClosed || !closedLocation(location) {
+					locations = append(locations, location)
+				}
+			}
+			if len(locations) == 0 {
+				locations = []OaLocation{{}}
+			}
+		}
+
+		for _, location := range locations {
+			locationKind := ""
+			if location.URL != "" {
+				locationKind = "additional"
+				if location.URL == best.URL {
+					locationKind = "best"
+				}
+			}
+
+			r := row{
+				record:       record,
+				apiresponse:  apiresponse,
+				location:     location,
+				locationKind: locationKind,
+				artudisOA:    artudisOA,
+				highestLevel: highestLevel,
+				options:      &c.options,
+			}
+			toCSVOutput := make([]string, len(c.columns))
+			for i, column := range c.columns {
+				toCSVOutput[i] = column.value(r)
+			}
+
+			err := c.w.Write(toCSVOutput)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// logUnknownTypes logs, once each, OA attachment types that have no weight
+// and so rank below every known type.
+func (c *csvRecordWriter) logUnknownTypes(publication Publication) {
+	weights := c.options.AttachmentWeights
+	if weights == nil {
+		weights = attachmentTypeToWeightMap
+	}
+	if c.loggedTypes == nil {
+		c.loggedTypes = map[string]bool{}
+	}
+
+	for _, attachment := range publication.Attachment {
+		_, known := weights[attachment.Type]
+		if bool(attachment.OpenAccess) && !known && !c.loggedTypes[attachment.Type] {
+			slog.Warn("Attachment type has no weight, treating it as 0.", "type", attachment.Type)
+			c.loggedTypes[attachment.Type] = true
+		}
+	}
+}
+
+func (options *WriterOptions) sherpaLink(issns string) string {
+	if options.SherpaKey != "" {
+		baseURL := options.SherpaURL
+		if baseURL == "" {
+			baseURL = SHERPAV2URI
+		}
+		return MakeSherpaV2Link(issns, options.SherpaKey, baseURL)
+	}
+
+	baseURL := options.SherpaURL
+	if baseURL == "" {
+		baseURL = SHERPAURI
+	}
+	return MakeSherpaLink(issns, baseURL)
+}
+
+// doi is the DOI oaDOI answered for, in the case PreserveDOICase asks for.
+// A DOI oaDOI gives that isn't the one looked up is written as it is.
+func (options *WriterOptions) doi(apiresponse APIResponse) string {
+	if options.PreserveDOICase && strings.EqualFold(apiresponse.Doi, NormalizeDOI(apiresponse.DOI)) {
+		return TrimDOI(apiresponse.DOI)
+	}
+	return apiresponse.Doi
+}
+
+// formatTime formats a time as RFC3339, or as an empty string if it is
+// unset.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// closedLocation reports whether an OA location is no use to someone who
+// wants to reuse the copy: it has no URL, or it is a publisher's copy with
+// no licence, which oaDOI calls bronze, free to read but not to reuse.
+func closedLocation(location OaLocation) bool {
+	if location.URL == "" {
+		return true
+	}
+	return location.HostType == "publisher" && location.License == ""
+}
+
+// oaMismatch reports whether Artudis and oaDOI disagree about a DOI having
+// an open access copy. A failed lookup says nothing about OA, so it is never
+// a mismatch.
+func oaMismatch(artudisOA bool, apiresponse APIResponse) bool {
+	if apiresponse.Status() != StatusOK {
+		return false
+	}
+	return artudisOA != apiresponse.IsOa
+}
+
+func (c *csvRecordWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// errorsRecordWriter writes every record to w, and the API responses that
+// errored, if any, to errors as well. Failing to write to errors is logged
+// rather than stopping the main report.
+type errorsRecordWriter struct {
+	w      RecordWriter
+	errors RecordWriter
+	failed bool
+}
+
+func (e *errorsRecordWriter) WriteHeader() error {
+	e.check(e.errors.WriteHeader())
+	return e.w.WriteHeader()
+}
+
+func (e *errorsRecordWriter) Write(record Record) error {
+	var errored []APIResponse
+	for _, apiresponse := range record.APIResponses {
+		if apiresponse.Errored() {
+			errored = append(errored, apiresponse)
+		}
+	}
+	if len(errored) > 0 && !e.failed {
+		errorRecord := record
+		errorRecord.APIResponses = errored
+		e.check(e.errors.Write(errorRecord))
+	}
+
+	return e.w.Write(record)
+}
+
+func (e *errorsRecordWriter) Flush() error {
+	e.check(e.errors.Flush())
+	return e.w.Flush()
+}
+
+func (e *errorsRecordWriter) check(err error) {
+	if err != nil && !e.failed {
+		slog.Error("Error writing to the error file.", "error", err)
+		e.failed = true
+	}
+}
+
+// flatJSONWriter writes each row as a JSON object on a line of its own, with
+// the values of the columns under their keys, in column order.
+type flatJSONWriter struct {
+	w       io.Writer
+	columns []column
+	err     error
+}
+
+func (f *flatJSONWriter) Write(record []string) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	var line bytes.Buffer
+	line.WriteByte('{')
+	for i, column := range f.columns {
+		if i > 0 {
+			line.WriteByte(',')
+		}
+		key, _ := json.Marshal(column.key)
+		value, err := json.Marshal(column.jsonValue(record[i]))
+		if err != nil {
+			f.err = err
+			return err
+		}
+		line.Write(key)
+		line.WriteByte(':')
+		line.Write(value)
+	}
+	line.WriteString("}\n")
+
+	_, f.err = f.w.Write(line.Bytes())
+	return f.err
+}
+
+func (f *flatJSONWriter) Flush() {}
+
+func (f *flatJSONWriter) Error() error {
+	return f.err
+}
+
+// mismatchRecordWriter writes to w only the API responses of a record that
+// are OA mismatches, and nothing for records with none.
+type mismatchRecordWriter struct {
+	w       RecordWriter
+	weights map[string]int
+}
+
+func (m *mismatchRecordWriter) WriteHeader() error {
+	return m.w.WriteHeader()
+}
+
+func (m *mismatchRecordWriter) Write(record Record) error {
+	artudisOA, _ := record.Publication.ArtudisOA(m.weights)
+	var mismatched []APIResponse
+	for _, apiresponse := range record.APIResponses {
+		if oaMismatch(artudisOA, apiresponse) {
+			mismatched = append(mismatched, apiresponse)
+		}
+	}
+	if len(mismatched) == 0 {
+		return nil
+	}
+
+	record.APIResponses = mismatched
+	return m.w.Write(record)
+}
+
+func (m *mismatchRecordWriter) Flush() error {
+	return m.w.Flush()
+}
+
+// changesRecordWriter writes to w only the API responses of a record that
+// are new or changed since the baseline, and nothing for records with none.
+// A record without API responses is written if it is new.
+type changesRecordWriter struct {
+	w        RecordWriter
+	baseline *Baseline
+}
+
+func (c *changesRecordWriter) WriteHeader() error {
+	return c.w.WriteHeader()
+}
+
+func (c *changesRecordWriter) Write(record Record) error {
+	if len(record.APIResponses) == 0 {
+		if c.baseline.Change(record.ID, APIResponse{}) != BaselineNew {
+			return nil
+		}
+		return c.w.Write(record)
+	}
+
+	var changed []APIResponse
+	for _, apiresponse := range record.APIResponses {
+		switch c.baseline.Change(record.ID, apiresponse) {
+		case BaselineNew, BaselineChanged:
+			changed = append(changed, apiresponse)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	record.APIResponses = changed
+	return c.w.Write(record)
+}
+
+func (c *changesRecordWriter) Flush() error {
+	return c.w.Flush()
+}
+
+// jsonRecordWriter writes one JSON object per record (NDJSON), including
+// the publication and every API response.
+type jsonRecordWriter struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonRecordWriter) WriteHeader() error {
+	return nil
+}
+
+func (j *jsonRecordWriter) Write(record Record) error {
+	return j.encoder.Encode(record)
+}
+
+func (j *jsonRecordWriter) Flush() error {
+	return nil
+}
+
+// discardRecordWriter writes nothing.
+type discardRecordWriter struct{}
+
+func (discardRecordWriter) WriteHeader() error {
+	return nil
+}
+
+func (discardRecordWriter) Write(record Record) error {
+	return nil
+}
+
+func (discardRecordWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,398 @@
+package oadoi
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCSVRowLength(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewRecordWriter("csv", &buf, WriterOptions{})
+
+	var record Record
+	record.APIResponses = []APIResponse{{}, {DOI: "10.1234/abc", HTTPStatus: "200 OK"}}
+
+	w.WriteHeader()
+	w.Write(record)
+	w.Flush()
+
+	reader := csv.NewReader(&buf)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows[0]) != len(columns) {
+		t.Errorf("csv header has %d columns, want %d", len(rows[0]), len(columns))
+	}
+	for _, row := range rows[1:] {
+		if len(row) != len(rows[0]) {
+			t.Errorf("csv row has %d columns, header has %d", len(row), len(rows[0]))
+		}
+	}
+}
+
+func TestCSVAllLocations(t *testing.T) {
+	apiresponse := APIResponse{DOI: "10.1234/abc", HTTPStatus: "200 OK"}
+	apiresponse.BestOaLocation = OaLocation{URL: "http://repository/abc", Version: "acceptedVersion", HostType: "repository"}
+	apiresponse.OaLocations = []OaLocation{
+		{URL: "http://publisher/abc", Version: "publishedVersion", HostType: "publisher", License: "cc-by"},
+		{URL: "http://publisher/bronze", Version: "publishedVersion", HostType: "publisher"},
+		apiresponse.BestOaLocation,
+	}
+	bronze := APIResponse{DOI: "10.1234/bronze", HTTPStatus: "200 OK"}
+	bronze.OaLocations = []OaLocation{{URL: "http://publisher/bronze", HostType: "publisher"}}
+	var record Record
+	record.APIResponses = []APIResponse{apiresponse, {DOI: "10.1234/none", HTTPStatus: "200 OK"}, bronze}
+
+	testTable := []struct {
+		allLocations  bool
+		includeClosed bool
+		output        [][]string
+	}{
+		{false, false, [][]string{{"http://repository/abc", "best"}, {"", ""}, {"", ""}}},
+		{true, false, [][]string{{"http://publisher/abc", "additional"}, {"http://repository/abc", "best"}, {"", ""}, {"", ""}}},
+		{true, true, [][]string{{"http://publisher/abc", "additional"}, {"http://publisher/bronze", "additional"}, {"http://repository/abc", "best"}, {"", ""}, {"http://publisher/bronze", "additional"}}},
+	}
+
+	for _, tt := range testTable {
+		var buf bytes.Buffer
+		w, _ := NewRecordWriter("csv", &buf, WriterOptions{AllLocations: tt.allLocations, IncludeClosed: tt.includeClosed})
+		w.Write(record)
+		w.Flush()
+
+		rows, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var realOutput [][]string
+		for _, row := range rows {
+			realOutput = append(realOutput, []string{row[7], row[17]})
+		}
+		if !reflect.DeepEqual(realOutput, tt.output) {
+			t.Errorf("csv with AllLocations %v, IncludeClosed %v => %v, want %v", tt.allLocations, tt.includeClosed, realOutput, tt.output)
+		}
+	}
+}
+
+func TestClosedLocation(t *testing.T) {
+	testTable := []struct {
+		location OaLocation
+		output   bool
+	}{
+		{OaLocation{URL: "http://repository/abc", HostType: "repository"}, false},
+		{OaLocation{URL: "http://publisher/abc", HostType: "publisher", License: "cc-by"}, false},
+		{OaLocation{URL: "http://publisher/abc", HostType: "publisher"}, true},
+		{OaLocation{HostType: "repository", License: "cc-by"}, true},
+	}
+
+	for _, tt := range testTable {
+		realOutput := closedLocation(tt.location)
+		if realOutput != tt.output {
+			t.Errorf("closedLocation(%+v) => %v, want %v", tt.location, realOutput, tt.output)
+		}
+	}
+}
+
+func TestOAMismatch(t *testing.T) {
+	oaResponse := APIResponse{DOI: "10.1234/abc", HTTPStatus: "200 OK"}
+	oaResponse.IsOa = true
+	closedResponse := APIResponse{DOI: "10.1234/abc", HTTPStatus: "200 OK"}
+	notFoundResponse := APIResponse{DOI: "10.1234/abc", HTTPStatus: "404 Not Found"}
+
+	testTable := []struct {
+		artudisOA   bool
+		apiresponse APIResponse
+		output      bool
+	}{
+		{true, oaResponse, false},
+		{false, closedResponse, false},
+		{false, oaResponse, true},
+		{true, closedResponse, true},
+		{true, notFoundResponse, false},
+	}
+
+	for _, tt := range testTable {
+		realOutput := oaMismatch(tt.artudisOA, tt.apiresponse)
+		if realOutput != tt.output {
+			t.Errorf("oaMismatch(%v, %+v) => %v, want %v", tt.artudisOA, tt.apiresponse, realOutput, tt.output)
+		}
+	}
+}
+
+func TestCSVColumns(t *testing.T) {
+	apiresponse := APIResponse{Scheme: "doi", DOI: "https://doi.org/10.1234/abc", HTTPStatus: "200 OK"}
+	apiresponse.Doi = "10.1234/abc"
+	apiresponse.Publisher = "Nature Publishing Group"
+	apiresponse.JournalName = "Nature"
+	apiresponse.Genre = "journal-article"
+	apiresponse.JournalIssns = "0028-0836"
+	apiresponse.DataStandard = 2
+	apiresponse.BestOaLocation = OaLocation{URLForPdf: "http://publisher/abc.pdf", HostType: "publisher"}
+	var record Record
+	record.ID = "pub1"
+	record.APIResponses = []APIResponse{apiresponse}
+
+	testTable := []struct {
+		columns []string
+		output  [][]string
+	}{
+		{[]string{"doi", "id"}, [][]string{{"API - DOI", "Artudis - ID"}, {"10.1234/abc", "pub1"}}},
+		{[]string{"status"}, [][]string{{"API - Status"}, {"ok"}}},
+		{[]string{"publisher", "journal_name", "journal_is_oa"}, [][]string{{"API - Publisher", "API - Journal Name", "API - Journal Is OA"}, {"Nature Publishing Group", "Nature", "false"}}},
+		{[]string{"best_oa_pdf_url", "best_oa_host_type", "best_oa_evidence"}, [][]string{{"API - Best OA PDF URL", "API - Best OA Host Type", "API - Best OA Evidence"}, {"http://publisher/abc.pdf", "publisher", ""}}},
+		{[]string{"genre", "data_standard"}, [][]string{{"API - Genre", "API - Data Standard"}, {"journal-article", "2"}}},
+		{[]string{"journal_issns", "sherpa_link"}, [][]string{{"API - Journal ISSNs", "API - Sherpa Link"}, {"0028-0836", MakeSherpaLink("0028-0836", SHERPAURI)}}},
+		{[]string{"identifier_scheme", "identifier_value", "doi"}, [][]string{{"Artudis - Identifier Scheme", "Artudis - Identifier Value", "API - DOI"}, {"doi", "https://doi.org/10.1234/abc", "10.1234/abc"}}},
+	}
+
+	for _, tt := range testTable {
+		var buf bytes.Buffer
+		w, err := NewRecordWriter("csv", &buf, WriterOptions{Columns: tt.columns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader()
+		w.Write(record)
+		w.Flush()
+
+		realOutput, _ := csv.NewReader(&buf).ReadAll()
+		if !reflect.DeepEqual(realOutput, tt.output) {
+			t.Errorf("csv with columns %v => %v, want %v", tt.columns, realOutput, tt.output)
+		}
+	}
+
+	var buf bytes.Buffer
+	w, _ := NewRecordWriter("csv", &buf, WriterOptions{Columns: []string{"id"}, NoHeader: true})
+	w.WriteHeader()
+	w.Write(record)
+	w.Flush()
+	if buf.String() != "pub1\n" {
+		t.Errorf("csv with NoHeader => %q, want %q", buf.String(), "pub1\n")
+	}
+
+	buf.Reset()
+	w, _ = NewRecordWriter("csv", &buf, WriterOptions{Columns: []string{"id", "status"}, NoHeader: true})
+	w.Write(Record{Publication: Publication{ID: "pub2"}})
+	w.Flush()
+	if buf.String() != "pub2,no-doi\n" {
+		t.Errorf("csv for a record without a DOI => %q, want %q", buf.String(), "pub2,no-doi\n")
+	}
+
+	_, err := NewRecordWriter("csv", &bytes.Buffer{}, WriterOptions{Columns: []string{"id", "nonsense"}})
+	if err == nil {
+		t.Errorf("NewRecordWriter accepted an unknown column")
+	}
+}
+
+func TestBaselineChange(t *testing.T) {
+	// Columns are found by header or key, in any order, and unknown ones
+	// are ignored.
+	report := strings.Join([]string{
+		"\ufeffAPI - Available OA,Notes,Artudis - ID,doi,Artudis - Identifier Value",
+		"true,,1,10.1234/abc,10.1234/abc",
+		"false,,2,10.1234/DEF,10.1234/def",
+		"false,,3,,10.1234/ghi",
+		"false,short row,4",
+	}, "\n")
+	baseline, err := readBaseline(strings.NewReader(report), ',')
+	if err != nil || baseline.Len() != 4 {
+		t.Fatalf("readBaseline => %v, %v, want 4 rows", baseline, err)
+	}
+
+	var testTable = []struct {
+		id          string
+		apiresponse APIResponse
+		change      string
+	}{
+		{"1", APIResponse{DOI: "10.1234/abc", APIResponseBody: APIResponseBody{IsOa: true}}, BaselineUnchanged},
+		{"1", APIResponse{DOI: "10.1234/ABC", APIResponseBody: APIResponseBody{IsOa: false}}, BaselineChanged},
+		{"2", APIResponse{DOI: "10.1234/def", APIResponseBody: APIResponseBody{IsOa: true}}, BaselineChanged},
+		{"3", APIResponse{DOI: "10.1234/ghi"}, BaselineUnchanged},
+		{"3", APIResponse{DOI: "10.1234/ghi", GETError: "connection refused"}, ""},
+		{"4", APIResponse{}, BaselineUnchanged},
+		{"5", APIResponse{DOI: "10.1234/abc", APIResponseBody: APIResponseBody{IsOa: true}}, BaselineNew},
+		{"1", APIResponse{DOI: "10.1234/xyz", GETError: "connection refused"}, BaselineNew},
+	}
+
+	for _, tt := range testTable {
+		change := baseline.Change(tt.id, tt.apiresponse)
+		if change != tt.change {
+			t.Errorf("Change(%v, %v) => %q, want %q", tt.id, tt.apiresponse.DOI, change, tt.change)
+		}
+	}
+
+	// Without an API - Available OA column, only new rows can be told.
+	baseline, err = readBaseline(strings.NewReader("id\tdoi\n1\t10.1234/abc\n"), '\t')
+	change := baseline.Change("1", APIResponse{DOI: "10.1234/abc", APIResponseBody: APIResponseBody{IsOa: true}})
+	if err != nil || change != BaselineUnchanged {
+		t.Errorf("Change without an OA column => %q, %v, want %q", change, err, BaselineUnchanged)
+	}
+
+	// Rows whose lookup errored, by their status or, without that column,
+	// their error columns, have no OA status to flip from.
+	for _, report := range []string{
+		"id,doi,api_oa,status\n1,10.1234/abc,false,network-error\n2,10.1234/def,false,not-found\n3,10.1234/ghi,false,ok\n",
+		"id,doi,api_oa,get_error,http_status\n1,10.1234/abc,false,connection refused,\n2,10.1234/def,false,,404 Not Found\n3,10.1234/ghi,false,,200 OK\n",
+	} {
+		baseline, err := readBaseline(strings.NewReader(report), ',')
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			id     string
+			doi    string
+			change string
+		}{
+			{"1", "10.1234/abc", BaselineUnchanged},
+			{"2", "10.1234/def", BaselineUnchanged},
+			{"3", "10.1234/ghi", BaselineChanged},
+		} {
+			change := baseline.Change(tt.id, APIResponse{DOI: tt.doi, HTTPStatus: "200 OK", APIResponseBody: APIResponseBody{IsOa: true}})
+			if change != tt.change {
+				t.Errorf("Change(%v, %v) against baseline %q => %q, want %q", tt.id, tt.doi, report, change, tt.change)
+			}
+		}
+	}
+
+	for _, report := range []string{"", "API - DOI,API - Available OA\n10.1234/abc,true\n"} {
+		_, err := readBaseline(strings.NewReader(report), ',')
+		if err == nil {
+			t.Errorf("readBaseline(%q) => no error", report)
+		}
+	}
+}
+
+func TestTSV(t *testing.T) {
+	apiresponse := APIResponse{DOI: "10.1234/abc", HTTPStatus: "200 OK"}
+	apiresponse.Title = "A title\twith a tab"
+	var record Record
+	record.ID = "pub1"
+	record.APIResponses = []APIResponse{apiresponse}
+
+	var buf bytes.Buffer
+	w, _ := NewRecordWriter("tsv", &buf, WriterOptions{Columns: []string{"id", "title"}})
+	w.WriteHeader()
+	w.Write(record)
+	w.Flush()
+
+	want := "Artudis - ID\tAPI - Title\npub1\t\"A title\twith a tab\"\n"
+	if buf.String() != want {
+		t.Errorf("tsv => %q, want %q", buf.String(), want)
+	}
+
+	reader := csv.NewReader(&buf)
+	reader.Comma = '\t'
+	rows, err := reader.ReadAll()
+	if err != nil || rows[1][1] != apiresponse.Title {
+		t.Errorf("reading tsv back => %v, %v, want title %q", rows, err, apiresponse.Title)
+	}
+}
+
+func TestFlatJSON(t *testing.T) {
+	apiresponse := APIResponse{DOI: "10.1234/abc", HTTPStatus: "200 OK"}
+	apiresponse.IsOa = true
+	apiresponse.Year = 2020
+	noYear := APIResponse{DOI: "10.1234/def", HTTPStatus: "200 OK"}
+	var record Record
+	record.ID = "pub1"
+	record.APIResponses = []APIResponse{apiresponse, noYear}
+
+	var buf bytes.Buffer
+	w, _ := NewRecordWriter("flatjson", &buf, WriterOptions{Columns: []string{"id", "api_oa", "year", "identifier_value"}})
+	w.WriteHeader()
+	w.Write(record)
+	w.Flush()
+
+	want := `{"id":"pub1","api_oa":true,"year":2020,"identifier_value":"10.1234/abc"}` + "\n" +
+		`{"id":"pub1","api_oa":false,"year":null,"identifier_value":"10.1234/def"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("flatjson => %q, want %q", buf.String(), want)
+	}
+}
+
+func TestXLSX(t *testing.T) {
+	apiresponse := APIResponse{DOI: "10.1234/abc", HTTPStatus: "200 OK"}
+	apiresponse.JournalIssns = "0028-0836"
+	apiresponse.Title = "Cats & <dogs>"
+	var record Record
+	record.ID = "pub1"
+	record.APIResponses = []APIResponse{apiresponse}
+
+	var buf bytes.Buffer
+	w, err := NewRecordWriter("xlsx", &buf, WriterOptions{Columns: []string{"id", "title", "sherpa_link"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteHeader()
+	w.Write(record)
+	err = w.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheet, err := zipReader.Open("xl/worksheets/sheet1.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sheet.Close()
+
+	var worksheet struct {
+		Rows []struct {
+			Cells []struct {
+				Ref   string `xml:"r,attr"`
+				Value string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	err = xml.NewDecoder(sheet).Decode(&worksheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var realOutput [][]string
+	for _, row := range worksheet.Rows {
+		var values []string
+		for _, cell := range row.Cells {
+			values = append(values, cell.Ref+"="+cell.Value)
+		}
+		realOutput = append(realOutput, values)
+	}
+	want := [][]string{
+		{"A1=Artudis - ID", "B1=API - Title", "C1=API - Sherpa Link"},
+		{"A2=pub1", "B2=Cats & <dogs>", "C2=" + MakeSherpaLink("0028-0836", SHERPAURI)},
+	}
+	if !reflect.DeepEqual(realOutput, want) {
+		t.Errorf("xlsx sheet => %v, want %v", realOutput, want)
+	}
+}
+
+func TestXLSXColumnName(t *testing.T) {
+	testTable := []struct {
+		input  int
+		output string
+	}{
+		{0, "A"},
+		{25, "Z"},
+		{26, "AA"},
+		{27, "AB"},
+		{701, "ZZ"},
+		{702, "AAA"},
+	}
+
+	for _, tt := range testTable {
+		realOutput := xlsxColumnName(tt.input)
+		if realOutput != tt.output {
+			t.Errorf("xlsxColumnName(%v) => %v, want %v", tt.input, realOutput, tt.output)
+		}
+	}
+}
@@ -0,0 +1,1003 @@
+package oadoi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Processor reads Artudis publications, one JSON object per line, looks up
+// their DOIs with Client and writes a report.
+type Processor struct {
+	Client *Client
+	// InputFormat is one of InputFormats.
+	InputFormat string
+	// CommentPrefixes start lines to skip, such as "//" or "#", after any
+	// leading whitespace. Like blank lines, they are counted in
+	// Summary.SkippedLines but aren't records.
+	CommentPrefixes []string
+	// MaxLine is the longest ndjson line to read, DefaultMaxLine if 0.
+	// Longer lines are skipped, as lines that aren't valid publications are.
+	MaxLine int
+	// Format is one of OutputFormats.
+	Format        string
+	WriterOptions WriterOptions
+	// Workers is the number of records processed at a time. It defaults to
+	// the client's concurrency. Only the client's concurrency limits how
+	// many requests are made at a time, so more workers than that keep
+	// requests going while other workers wait to retry, or answer records
+	// without a request, from the cache, ledger or snapshot, or because
+	// they have no DOI.
+	Workers int
+	// Ordered writes records in input order. Records that finish early are
+	// held in memory until every line before them has been written; in the
+	// worst case (the first line is the slowest) that is the whole input.
+	Ordered bool
+	// Sort, if set, writes records sorted by one of the SortKeys. Every
+	// record of an input is held in memory until the last has been looked
+	// up, so memory use grows with the input; inputs are sorted separately
+	// unless they are processed together with ProcessLines.
+	Sort SortOrder
+	// Strict stops processing with an error at the first line that isn't a
+	// valid publication, publication with identifiers in an unrecognized
+	// shape, or lookup that errored, including with a 404.
+	Strict bool
+	// DeadLetter, if set, receives the original line of every record whose
+	// lookup failed, so it can be reprocessed.
+	DeadLetter io.Writer
+	// Errors, if set, receives a second report in the same format, of only
+	// the API responses that errored.
+	Errors io.Writer
+	// Rejects, if set, receives every line that could not be decoded.
+	Rejects io.Writer
+	// NotOADOIs, if set, receives the normalized DOI of every successful
+	// lookup that found no open access copy, one per line, once each. The
+	// DOIs keep their case if WriterOptions.PreserveDOICase is set.
+	NotOADOIs io.Writer
+	// WebhookURL, if set, receives every record written, POSTed by the
+	// Client as JSON arrays of up to WebhookBatchSize records,
+	// DefaultWebhookBatchSize if 0. Records that can't be delivered are
+	// logged, and also written to Errors if WebhookErrors is set.
+	WebhookURL       string
+	WebhookBatchSize int
+	WebhookErrors    bool
+	// Progress, if set, is updated as records are read and written.
+	Progress *Progress
+	// Types, if not empty, are the publication types to look up and report;
+	// others are left out. Case is ignored.
+	Types []string
+	// LookupSchemes are the identifier schemes whose values are looked up
+	// in oaDOI, ignoring case. Only doi is looked up if it is empty.
+	LookupSchemes []string
+	// SkipOA leaves out publications that already have an open access
+	// attachment in Artudis, without looking them up.
+	SkipOA bool
+	// YearMin and YearMax, if not 0, leave out API responses whose year is
+	// outside the range, and records left with none. This happens after the
+	// lookup, so it saves no quota. Responses with no year are left out too,
+	// unless IncludeUnknownYear is set.
+	YearMin            int
+	YearMax            int
+	IncludeUnknownYear bool
+	// MinDataStandard, if not 0, leaves out oaDOI records whose
+	// data_standard is lower, and records left with none, as YearMin does.
+	// Responses without a record, such as 404s, are kept.
+	MinDataStandard int
+	// Sample, if positive, is how many lines of each input to dispatch to
+	// the workers as publications; blank and comment lines, which are
+	// skipped, don't count. The rest are left unread. Lines given to
+	// ProcessLines together count as one input.
+	Sample int
+	// DryRun reads and decodes the input as usual but looks nothing up;
+	// every DOI gets a skipped response instead.
+	DryRun bool
+	// PrintURLs, if set, looks nothing up, as DryRun does, but writes the
+	// URL that each DOI would be requested from to it, one per line, for
+	// checking how the email and DOIParam are encoded.
+	PrintURLs io.Writer
+	// Dedupe looks up each DOI once for the life of the Processor, reusing
+	// the response for later records with the same DOI.
+	Dedupe bool
+	// MaxConsecutiveErrors, if positive, stops processing with an error once
+	// that many lookups in a row have failed, as they would if oaDOI were
+	// down. Any successful lookup starts the count again.
+	MaxConsecutiveErrors int
+	// RecoverPanics recovers from a panic while processing a line, such as
+	// one set off by a malformed response, logging it with the line and
+	// record ID and counting it in Summary.Panics, rather than letting it
+	// stop the program. The record is left out of the report.
+	RecoverPanics bool
+	// PrimaryDOIOnly reports one DOI per publication with several: the
+	// first that oaDOI says is open access, or else the first. Every DOI is
+	// still looked up.
+	PrimaryDOIOnly bool
+	// Aggregate reports one response per publication, combining those of
+	// all its DOIs; see aggregateResponses.
+	Aggregate bool
+	// Ledger, if set, answers lookups of DOIs it has from an earlier run,
+	// and records the answers oaDOI gives to the rest.
+	Ledger *Ledger
+	// CountOnly writes no report, only counting the records in Total, as
+	// a full run would.
+	CountOnly bool
+	// OnlyMismatches writes only the API responses that are OA mismatches,
+	// and no rows for records without any. Total still counts every record.
+	OnlyMismatches bool
+	// ChangesOnly writes only the rows that are new or have changed OA
+	// status since WriterOptions.Baseline, which must be set. Total still
+	// counts every record.
+	ChangesOnly bool
+	// FlushInterval, if positive, flushes the report this often while
+	// records are being written, so that a run that stops early leaves the
+	// rows written so far. Otherwise the report is flushed at the end.
+	FlushInterval time.Duration
+	// OutputBuffer is how many finished records may wait to be written
+	// without holding up the workers that finished them. With 0 a worker
+	// waits for each of its records to be written before taking the next
+	// line, which only matters when writing is as slow as looking up, as
+	// it can be with many workers and a slow disk. Records are still
+	// written in the order they finish, or with Ordered, in input order.
+	OutputBuffer int
+
+	consecutiveErrors atomic.Int64
+
+	lookupsMutex sync.Mutex
+	lookups      map[string]*sharedLookup
+
+	totalMutex sync.Mutex
+	total      Summary
+
+	notOAMutex   sync.Mutex
+	notOAWritten map[string]bool
+
+	printURLsMutex sync.Mutex
+}
+
+// Total is the summary of every record written by the Processor so far.
+func (processor *Processor) Total() Summary {
+	processor.totalMutex.Lock()
+	defer processor.totalMutex.Unlock()
+
+	// Copy the maps, which later files are still merged into.
+	total := processor.total
+	total.StatusCodes, total.GETErrorCategories = nil, nil
+	total.Merge(Summary{StatusCodes: processor.total.StatusCodes, GETErrorCategories: processor.total.GETErrorCategories})
+	return total
+}
+
+// sharedLookup is a Dedupe lookup; done is closed once response is set.
+type sharedLookup struct {
+	done     chan struct{}
+	response APIResponse
+}
+
+// A Line is one line of an Artudis export, and the name of the export it
+// came from.
+type Line struct {
+	Source string
+	Bytes  []byte
+	// TooLong is set, and Bytes left empty, for a line longer than the
+	// LineReader's limit.
+	TooLong bool
+}
+
+// ProcessReader reads publications from r, an export named source, and
+// writes the report to w. If ctx is done part way through, the records
+// already looked up are written and the DOIs of the rest are logged.
+func (processor *Processor) ProcessReader(ctx context.Context, source string, r io.Reader, w io.Writer) error {
+	lineReader, err := NewLineReader(processor.InputFormat, source, r, processor.MaxLine)
+	if err != nil {
+		return err
+	}
+
+	err = processor.process(ctx, lineReader.Next, w)
+	if err != nil {
+		return err
+	}
+	return lineReader.Err()
+}
+
+// ProcessLines is ProcessReader for lines that have already been read, which
+// may come from several exports.
+func (processor *Processor) ProcessLines(ctx context.Context, lines []Line, w io.Writer) error {
+	i := 0
+	next := func() (Line, bool) {
+		if i == len(lines) {
+			return Line{}, false
+		}
+		i++
+		return lines[i-1], true
+	}
+
+	return processor.process(ctx, next, w)
+}
+
+func (processor *Processor) process(ctx context.Context, next func() (Line, bool), w io.Writer) error {
+	recordWriter, err := NewRecordWriter(processor.Format, w, processor.WriterOptions)
+	if err != nil {
+		return err
+	}
+	if processor.CountOnly {
+		recordWriter = discardRecordWriter{}
+	}
+	if processor.OnlyMismatches {
+		recordWriter = &mismatchRecordWriter{w: recordWriter, weights: processor.WriterOptions.AttachmentWeights}
+	}
+	if processor.ChangesOnly {
+		recordWriter = &changesRecordWriter{w: recordWriter, baseline: processor.WriterOptions.Baseline}
+	}
+	var errorWriter RecordWriter
+	if processor.Errors != nil {
+		errorWriter, err = NewRecordWriter(processor.Format, processor.Errors, processor.WriterOptions)
+		if err != nil {
+			return err
+		}
+		recordWriter = &errorsRecordWriter{w: recordWriter, errors: errorWriter}
+	}
+	// The webhook goes outside the error file, so that records it fails to
+	// deliver are written before the error file is flushed.
+	if processor.WebhookURL != "" {
+		webhook := &webhookRecordWriter{
+			w:         recordWriter,
+			client:    processor.Client,
+			url:       processor.WebhookURL,
+			batchSize: processor.WebhookBatchSize,
+		}
+		if webhook.batchSize < 1 {
+			webhook.batchSize = DefaultWebhookBatchSize
+		}
+		if processor.WebhookErrors {
+			webhook.failed = errorWriter
+		}
+		recordWriter = webhook
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var failure error
+	var failOnce sync.Once
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	output := make(chan Record, processor.OutputBuffer)
+
+	var waitgroupOutput sync.WaitGroup
+	waitgroupOutput.Add(1)
+	go processor.processOutput(output, recordWriter, &waitgroupOutput)
+
+	workers := processor.Workers
+	if workers < 1 {
+		workers = processor.Client.Concurrency()
+	}
+
+	// A fixed pool of workers takes lines off the channel, rather than a
+	// goroutine per line, so memory use doesn't grow with the input.
+	unfinished := unfinishedDOIs{lookupScheme: processor.lookupScheme}
+	lines := make(chan inputLine)
+	var waitgroupWorkers sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		waitgroupWorkers.Add(1)
+		go func() {
+			defer waitgroupWorkers.Done()
+			for line := range lines {
+				processor.processLine(ctx, line, &unfinished, fail, output)
+			}
+		}()
+	}
+
+	lineNumber, sampled := 0, 0
+	for ctx.Err() == nil && (processor.Sample <= 0 || sampled < processor.Sample) {
+		line, ok := next()
+		if !ok {
+			break
+		}
+		lineNumber++
+		if line.TooLong || !processor.blankOrComment(line.Bytes) {
+			sampled++
+		}
+		if processor.Progress != nil {
+			processor.Progress.LinesRead.Add(1)
+			processor.Progress.BytesRead.Add(int64(len(line.Bytes) + 1))
+		}
+		lines <- inputLine{number: lineNumber, Line: line}
+	}
+	close(lines)
+
+	// The rest of the input was never dispatched. Read through it anyway so
+	// that its DOIs can be reported for resuming.
+	if ctx.Err() != nil {
+		for line, ok := next(); ok; line, ok = next() {
+			var publication Publication
+			if json.Unmarshal(line.Bytes, &publication) == nil {
+				unfinished.add(publication)
+			}
+		}
+	}
+
+	waitgroupWorkers.Wait()
+	close(output)
+	waitgroupOutput.Wait()
+
+	unfinished.report()
+
+	return failure
+}
+
+type inputLine struct {
+	number int
+	Line
+}
+
+// unfinishedDOIs collects the DOIs of records that were left out of the
+// output because the run was stopped before they were looked up.
+type unfinishedDOIs struct {
+	lookupScheme func(scheme string) bool
+
+	mutex sync.Mutex
+	dois  []string
+}
+
+func (unfinished *unfinishedDOIs) add(publication Publication) {
+	unfinished.mutex.Lock()
+	defer unfinished.mutex.Unlock()
+
+	for _, identifier := range publication.Identifier {
+		if unfinished.lookupScheme(identifier.Scheme) {
+			unfinished.dois = append(unfinished.dois, identifier.Value)
+		}
+	}
+}
+
+func (unfinished *unfinishedDOIs) report() {
+	if len(unfinished.dois) == 0 {
+		return
+	}
+
+	slog.Warn(fmt.Sprintf("%d DOIs were not looked up before stopping:", len(unfinished.dois)))
+	for _, doi := range unfinished.dois {
+		slog.Warn("Not looked up", "doi", doi)
+	}
+}
+
+func (processor *Processor) processOutput(output <-chan Record, w RecordWriter, waitgroupOutput *sync.WaitGroup) {
+	defer waitgroupOutput.Done()
+
+	// After a write error keep draining the channel, so that the goroutines
+	// sending records don't block forever, but stop writing.
+	err := w.WriteHeader()
+	if err != nil {
+		slog.Error("Error writing header.", "error", err)
+	}
+
+	loggedVariants := map[string]bool{}
+	var summary Summary
+
+	writeRecord := func(record Record) {
+		if !record.rejected && !record.skippedLine {
+			summary.ParsedRecords++
+		}
+		if record.rejected {
+			summary.RejectedLines++
+			// Lines that were too long to read have nothing to write.
+			if processor.Rejects != nil && record.Raw != nil {
+				_, err := processor.Rejects.Write(append(record.Raw, '\n'))
+				if err != nil {
+					slog.Error("Error writing line to reject file.", "line", record.Line, "error", err)
+				}
+			}
+		}
+		if record.skippedOA {
+			summary.SkippedOA++
+		}
+		if record.skippedType {
+			summary.SkippedType++
+		}
+		if record.skippedLine {
+			summary.SkippedLines++
+		}
+		if record.panicked {
+			summary.Panics++
+			if processor.Progress != nil {
+				processor.Progress.Errors.Add(1)
+			}
+		}
+		if record.omitted {
+			return
+		}
+
+		record, keep := processor.filterYears(record)
+		if keep {
+			responses := len(record.APIResponses)
+			record, keep = processor.filterDataStandard(record)
+			summary.BelowDataStandard += responses - len(record.APIResponses)
+		}
+		if !keep {
+			if processor.Progress != nil {
+				processor.Progress.RecordsDone.Add(1)
+			}
+			return
+		}
+
+		summary.Add(record)
+
+		if record.Publication.LowWeightOA(processor.WriterOptions.AttachmentWeights) {
+			_, bestType := record.Publication.ArtudisOA(processor.WriterOptions.AttachmentWeights)
+			slog.Warn("Publication is OA in Artudis only through a low-weight attachment, which may be mislabelled.",
+				"id", record.ID, "type", bestType, "file", record.SourceFile)
+		}
+
+		variant := record.IdentifierVariant
+		if variant != IdentifierVariantCanonical && variant != IdentifierVariantNone && !loggedVariants[variant] {
+			slog.Info("Detected identifier variant", "variant", variant, "file", record.SourceFile)
+			loggedVariants[variant] = true
+		}
+
+		if err == nil {
+			err = w.Write(record)
+			if err != nil {
+				slog.Error("Error writing record.", "error", err)
+			}
+		}
+
+		if processor.Progress != nil {
+			processor.Progress.RecordsDone.Add(1)
+			if record.Failed() {
+				processor.Progress.Errors.Add(1)
+			}
+		}
+
+		if processor.NotOADOIs != nil {
+			processor.writeNotOADOIs(record)
+		}
+
+		if processor.DeadLetter != nil && record.Failed() {
+			_, err := processor.DeadLetter.Write(append(record.Raw, '\n'))
+			if err != nil {
+				slog.Error("Error writing record to dead letter file.", "id", record.ID, "error", err)
+			}
+		}
+	}
+
+	// In ordered mode records that complete early wait in pending until
+	// every line before them has been written.
+	nextLine := 1
+	pending := map[int]Record{}
+
+	var sorted []Record
+
+	handleRecord := func(record Record) {
+		if processor.Sort.Key != "" {
+			sorted = append(sorted, record)
+			return
+		}
+		if !processor.Ordered {
+			writeRecord(record)
+			return
+		}
+
+		pending[record.Line] = record
+		for {
+			next, ok := pending[nextLine]
+			if !ok {
+				break
+			}
+			delete(pending, nextLine)
+			nextLine++
+			writeRecord(next)
+		}
+	}
+
+	// Flushing happens between records, on this goroutine, so it never
+	// interrupts a row.
+	var flushTicks <-chan time.Time
+	if processor.FlushInterval > 0 {
+		ticker := time.NewTicker(processor.FlushInterval)
+		defer ticker.Stop()
+		flushTicks = ticker.C
+	}
+
+records:
+	for {
+		select {
+		case record, ok := <-output:
+			if !ok {
+				break records
+			}
+			handleRecord(record)
+		case <-flushTicks:
+			if err == nil {
+				err = w.Flush()
+				if err != nil {
+					slog.Error("Error writing record.", "error", err)
+				}
+			}
+		}
+	}
+
+	remaining := make([]int, 0, len(pending))
+	for line := range pending {
+		remaining = append(remaining, line)
+	}
+	sort.Ints(remaining)
+	for _, line := range remaining {
+		writeRecord(pending[line])
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return processor.Sort.less(sorted[i], sorted[j])
+	})
+	for _, record := range sorted {
+		writeRecord(record)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		slog.Error("Error writing record.", "error", err)
+	}
+
+	slog.Info("Summary: " + summary.String())
+
+	processor.totalMutex.Lock()
+	processor.total.Merge(summary)
+	processor.totalMutex.Unlock()
+}
+
+// comment reports whether a line, with surrounding whitespace trimmed,
+// starts with one of the CommentPrefixes.
+// blankOrComment reports whether line is blank or a comment, to be skipped
+// rather than read as a publication.
+func (processor *Processor) blankOrComment(line []byte) bool {
+	trimmed := bytes.TrimSpace(line)
+	return len(trimmed) == 0 || processor.comment(trimmed)
+}
+
+func (processor *Processor) comment(line []byte) bool {
+	for _, prefix := range processor.CommentPrefixes {
+		if prefix != "" && bytes.HasPrefix(line, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotOADOIs writes the DOIs of record that oaDOI found no open access
+// copy of to NotOADOIs, leaving out any already written. It may be called
+// for several inputs at once.
+func (processor *Processor) writeNotOADOIs(record Record) {
+	processor.notOAMutex.Lock()
+	defer processor.notOAMutex.Unlock()
+
+	if processor.notOAWritten == nil {
+		processor.notOAWritten = map[string]bool{}
+	}
+	for _, apiResponse := range record.APIResponses {
+		if apiResponse.Status() != StatusOK || apiResponse.IsOa {
+			continue
+		}
+		key := NormalizeDOI(apiResponse.DOI)
+		if processor.notOAWritten[key] {
+			continue
+		}
+		processor.notOAWritten[key] = true
+		doi := key
+		if processor.WriterOptions.PreserveDOICase {
+			doi = TrimDOI(apiResponse.DOI)
+		}
+		_, err := io.WriteString(processor.NotOADOIs, doi+"\n")
+		if err != nil {
+			slog.Error("Error writing DOI to the not OA file.", "doi", doi, "error", err)
+		}
+	}
+}
+
+// processLine is processPublication, recovering from a panic if
+// RecoverPanics is set.
+func (processor *Processor) processLine(ctx context.Context, line inputLine, unfinished *unfinishedDOIs, fail func(error), output chan<- Record) {
+	if processor.RecoverPanics {
+		defer processor.recoverLine(line, output)
+	}
+	processor.processPublication(ctx, line, unfinished, fail, output)
+}
+
+// lookupPanic is a panic recovered in a lookup, to be panicked again by the
+// worker processing its line, with the stack where it happened.
+type lookupPanic struct {
+	value any
+	stack []byte
+}
+
+// recoverLine, deferred, recovers from a panic processing line, and sends
+// the record for it that processPublication never sent. Panics always
+// happen before processPublication sends its record, so Ordered gets one
+// record for the line either way.
+func (processor *Processor) recoverLine(line inputLine, output chan<- Record) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	stack := debug.Stack()
+	if lookup, ok := value.(lookupPanic); ok {
+		value, stack = lookup.value, lookup.stack
+	}
+
+	// Only the ID is decoded, in case decoding the rest was what panicked.
+	var publication struct {
+		ID string `json:"__id__"`
+	}
+	json.Unmarshal(line.Bytes, &publication)
+	slog.Error("Recovered from a panic processing record; leaving it out.",
+		"file", line.Source, "line", line.number, "id", publication.ID, "panic", fmt.Sprint(value), "stack", string(stack))
+	output <- Record{Line: line.number, Raw: line.Bytes, omitted: true, panicked: true}
+}
+
+func (processor *Processor) processPublication(ctx context.Context, line inputLine, unfinished *unfinishedDOIs, fail func(error), output chan<- Record) {
+	var record Record
+	record.Line = line.number
+	record.Raw = line.Bytes
+	record.SourceFile = line.Source
+
+	// Every line sends a record, even if there is nothing to write, so that
+	// Ordered knows not to wait for it.
+	if line.TooLong {
+		if processor.Strict {
+			fail(fmt.Errorf("line %d of %s is too long to read", line.number, line.Source))
+		}
+		slog.Warn("Skipping line that is too long to read.", "file", line.Source, "line", line.number)
+		output <- Record{Line: line.number, omitted: true, rejected: true}
+		return
+	}
+
+	// Blank lines between publications are left by some editors and are
+	// not worth a warning, and comments are added by some pipelines.
+	if processor.blankOrComment(line.Bytes) {
+		output <- Record{Line: line.number, omitted: true, skippedLine: true}
+		return
+	}
+
+	err := json.Unmarshal(line.Bytes, &record.Publication)
+	if err != nil {
+		if processor.Strict {
+			fail(fmt.Errorf("line %d of %s is not a valid publication: %v", line.number, line.Source, err))
+		}
+		slog.Warn("Skipping line that is not a valid publication.", "file", line.Source, "line", line.number, "error", err)
+		output <- Record{Line: line.number, Raw: line.Bytes, omitted: true, rejected: true}
+		return
+	}
+
+	if processor.Strict && record.IdentifierVariant == IdentifierVariantUnrecognized {
+		fail(fmt.Errorf("unrecognized identifier shape in record %s on line %d of %s", record.ID, line.number, line.Source))
+		output <- Record{Line: line.number, omitted: true}
+		return
+	}
+
+	if len(processor.Types) > 0 && !processor.wantedType(record.Type) {
+		output <- Record{Line: line.number, omitted: true, skippedType: true}
+		return
+	}
+
+	if processor.SkipOA {
+		if artudisOA, _ := record.Publication.ArtudisOA(nil); artudisOA {
+			output <- Record{Line: line.number, omitted: true, skippedOA: true}
+			return
+		}
+	}
+
+	seen := map[string]bool{}
+	var identifiers []Identifier
+	for _, identifier := range record.Publication.Identifier {
+		if processor.lookupScheme(identifier.Scheme) {
+			normalized := NormalizeDOI(identifier.Value)
+			if seen[normalized] {
+				record.lookupsSaved++
+				continue
+			}
+			seen[normalized] = true
+			identifiers = append(identifiers, identifier)
+		}
+	}
+
+	// The DOIs of a publication are looked up at the same time, each still
+	// waiting its turn with the client, and reported in identifier order.
+	if len(identifiers) > 0 {
+		record.APIResponses = make([]APIResponse, len(identifiers))
+	}
+	shared := make([]bool, len(identifiers))
+	panics := make([]*lookupPanic, len(identifiers))
+	var waitgroupLookups sync.WaitGroup
+	for i, identifier := range identifiers {
+		waitgroupLookups.Add(1)
+		go func(i int, identifier Identifier) {
+			defer waitgroupLookups.Done()
+			// A panic here can't be recovered by the worker, which is on
+			// another goroutine, so it is passed on to it.
+			if processor.RecoverPanics {
+				defer func() {
+					if value := recover(); value != nil {
+						panics[i] = &lookupPanic{value: value, stack: debug.Stack()}
+					}
+				}()
+			}
+			record.APIResponses[i], shared[i] = processor.lookup(ctx, identifier.Value)
+			if !shared[i] {
+				processor.countConsecutiveErrors(record.APIResponses[i], fail)
+			}
+			record.APIResponses[i].Scheme = identifier.Scheme
+		}(i, identifier)
+	}
+	waitgroupLookups.Wait()
+	for _, lookup := range panics {
+		if lookup != nil {
+			panic(*lookup)
+		}
+	}
+	for _, lookupShared := range shared {
+		if lookupShared {
+			record.lookupsSaved++
+		}
+	}
+
+	for _, apiResponse := range record.APIResponses {
+		if apiResponse.notAttempted {
+			unfinished.add(record.Publication)
+			output <- Record{Line: line.number, omitted: true}
+			return
+		}
+	}
+
+	if processor.Strict {
+		for _, apiResponse := range record.APIResponses {
+			if apiResponse.Errored() {
+				fail(fmt.Errorf("lookup of %s for record %s on line %d of %s failed: %s",
+					apiResponse.DOI, record.ID, line.number, line.Source, apiResponse.Status()))
+				output <- Record{Line: line.number, omitted: true}
+				return
+			}
+		}
+	}
+
+	if processor.PrimaryDOIOnly && len(record.APIResponses) > 1 {
+		record.APIResponses = []APIResponse{primaryResponse(record.APIResponses)}
+	}
+	if processor.Aggregate && len(record.APIResponses) > 0 {
+		record.APIResponses = []APIResponse{aggregateResponses(record.APIResponses)}
+	}
+
+	output <- record
+}
+
+// primaryResponse picks the response to report for a publication with
+// several DOIs: the first that is open access, or else the first.
+func primaryResponse(apiResponses []APIResponse) APIResponse {
+	for _, apiResponse := range apiResponses {
+		if apiResponse.Status() == StatusOK && apiResponse.IsOa {
+			return apiResponse
+		}
+	}
+	return apiResponses[0]
+}
+
+// aggregateResponses combines the responses for the DOIs of a publication
+// into one, which is open access if any of them is. It is the open access
+// response whose best location has the best version by oaVersionWeights,
+// the first of them if several do, or else the first successful response,
+// or else the first, with DOIsChecked set to the number of responses.
+func aggregateResponses(apiResponses []APIResponse) APIResponse {
+	chosen := -1
+	for i, apiResponse := range apiResponses {
+		if apiResponse.Status() != StatusOK {
+			continue
+		}
+		if chosen < 0 {
+			chosen = i
+			continue
+		}
+		best := apiResponses[chosen]
+		if apiResponse.IsOa && (!best.IsOa ||
+			oaVersionWeights[apiResponse.BestOaLocation.Version] > oaVersionWeights[best.BestOaLocation.Version]) {
+			chosen = i
+		}
+	}
+	if chosen < 0 {
+		chosen = 0
+	}
+
+	aggregate := apiResponses[chosen]
+	aggregate.DOIsChecked = len(apiResponses)
+	return aggregate
+}
+
+// countConsecutiveErrors keeps count of the lookups that failed in a row,
+// and calls fail once there are MaxConsecutiveErrors of them.
+func (processor *Processor) countConsecutiveErrors(apiResponse APIResponse, fail func(error)) {
+	if processor.MaxConsecutiveErrors <= 0 {
+		return
+	}
+
+	switch status := apiResponse.Status(); status {
+	case StatusOK, StatusNotFound:
+		processor.consecutiveErrors.Store(0)
+	case StatusNetworkError, StatusTimeout, StatusAPIError, StatusDecodeError:
+		count := processor.consecutiveErrors.Add(1)
+		if count >= int64(processor.MaxConsecutiveErrors) {
+			fail(fmt.Errorf("%d lookups in a row failed, the last with status %s", count, status))
+		}
+	}
+}
+
+// lookup queries the client for a DOI. With Dedupe, a DOI that has already
+// been looked up, or is being looked up by another worker, gets that
+// response instead, and shared is true.
+func (processor *Processor) lookup(ctx context.Context, doi string) (apiResponse APIResponse, shared bool) {
+	if processor.PrintURLs != nil {
+		processor.printURL(doi)
+	}
+	if processor.DryRun || processor.PrintURLs != nil {
+		return APIResponse{DOI: doi, Skipped: true}, false
+	}
+
+	if !processor.Dedupe {
+		apiResponse = processor.clientLookup(ctx, doi)
+		return apiResponse, false
+	}
+
+	key := NormalizeDOI(doi)
+	processor.lookupsMutex.Lock()
+	if processor.lookups == nil {
+		processor.lookups = map[string]*sharedLookup{}
+	}
+	lookup, found := processor.lookups[key]
+	if !found {
+		lookup = &sharedLookup{done: make(chan struct{})}
+		processor.lookups[key] = lookup
+	}
+	processor.lookupsMutex.Unlock()
+
+	if !found {
+		// If the lookup panics, the records waiting for it get an error
+		// instead of waiting forever.
+		finished := false
+		defer func() {
+			if !finished {
+				lookup.response = APIResponse{DOI: doi, GETError: "lookup panicked"}
+				close(lookup.done)
+			}
+		}()
+		lookup.response = processor.clientLookup(ctx, doi)
+		if lookup.response.notAttempted {
+			processor.lookupsMutex.Lock()
+			delete(processor.lookups, key)
+			processor.lookupsMutex.Unlock()
+		}
+		finished = true
+		close(lookup.done)
+		return lookup.response, false
+	}
+
+	select {
+	case <-lookup.done:
+	case <-ctx.Done():
+		return APIResponse{DOI: doi, notAttempted: true}, false
+	}
+
+	apiResponse = lookup.response
+	apiResponse.DOI = doi
+	return apiResponse, !apiResponse.notAttempted
+}
+
+// printURL writes the URL that doi would be requested from to PrintURLs.
+func (processor *Processor) printURL(doi string) {
+	requestURL, err := processor.Client.requestURL(processor.Client.requestDOI(doi))
+	if err != nil {
+		slog.Error("Error making request URL.", "doi", doi, "error", err)
+		return
+	}
+
+	processor.printURLsMutex.Lock()
+	defer processor.printURLsMutex.Unlock()
+	_, err = io.WriteString(processor.PrintURLs, requestURL+"\n")
+	if err != nil {
+		slog.Error("Error writing request URL.", "doi", doi, "error", err)
+	}
+}
+
+// clientLookup looks a DOI up in the Ledger or with the Client, counting
+// client lookups in Progress and adding their answers to the Ledger.
+func (processor *Processor) clientLookup(ctx context.Context, doi string) APIResponse {
+	if processor.Ledger != nil {
+		apiResponse, ok := processor.Ledger.lookup(doi)
+		if ok {
+			apiResponse.DOI = doi
+			return apiResponse
+		}
+	}
+
+	apiResponse, err := processor.Client.Lookup(ctx, doi)
+	if err == nil && processor.Progress != nil {
+		processor.Progress.Lookups.Add(1)
+	}
+
+	if err == nil && processor.Ledger != nil && cacheable(apiResponse) {
+		err := processor.Ledger.add(doi, apiResponse)
+		if err != nil {
+			slog.Error("Error writing to the resume ledger.", "doi", doi, "error", err)
+		}
+	}
+	return apiResponse
+}
+
+func (processor *Processor) wantedType(publicationType string) bool {
+	for _, wanted := range processor.Types {
+		if strings.EqualFold(wanted, publicationType) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupScheme reports whether identifiers with the scheme are looked up.
+func (processor *Processor) lookupScheme(scheme string) bool {
+	if len(processor.LookupSchemes) == 0 {
+		return strings.EqualFold(scheme, "doi")
+	}
+	for _, wanted := range processor.LookupSchemes {
+		if strings.EqualFold(wanted, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterYears removes the API responses outside YearMin and YearMax from a
+// record, and reports whether the record should still be written.
+func (processor *Processor) filterYears(record Record) (Record, bool) {
+	if (processor.YearMin == 0 && processor.YearMax == 0) || len(record.APIResponses) == 0 {
+		return record, true
+	}
+
+	var kept []APIResponse
+	for _, apiresponse := range record.APIResponses {
+		year := apiresponse.Year
+		switch {
+		case year == 0 && !processor.IncludeUnknownYear:
+		case year != 0 && processor.YearMin != 0 && year < processor.YearMin:
+		case year != 0 && processor.YearMax != 0 && year > processor.YearMax:
+		default:
+			kept = append(kept, apiresponse)
+		}
+	}
+
+	record.APIResponses = kept
+	return record, len(kept) > 0
+}
+
+// filterDataStandard removes the oaDOI records below MinDataStandard from a
+// record, and reports whether the record should still be written.
+func (processor *Processor) filterDataStandard(record Record) (Record, bool) {
+	if processor.MinDataStandard == 0 || len(record.APIResponses) == 0 {
+		return record, true
+	}
+
+	var kept []APIResponse
+	for _, apiresponse := range record.APIResponses {
+		if apiresponse.Status() != StatusOK || apiresponse.DataStandard >= processor.MinDataStandard {
+			kept = append(kept, apiresponse)
+		}
+	}
+
+	record.APIResponses = kept
+	return record, len(kept) > 0
+}
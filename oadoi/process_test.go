@@ -0,0 +1,958 @@
+package oadoi
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func runProcessOutput(processor *Processor, records ...Record) *bytes.Buffer {
+	var buf bytes.Buffer
+	output := make(chan Record, len(records))
+	for _, record := range records {
+		output <- record
+	}
+	close(output)
+
+	w, _ := NewRecordWriter("csv", &buf, WriterOptions{})
+	var waitgroupOutput sync.WaitGroup
+	waitgroupOutput.Add(1)
+	processor.processOutput(output, w, &waitgroupOutput)
+	return &buf
+}
+
+func TestProcessOutput(t *testing.T) {
+	var record Record
+	record.ID = "pub1"
+	record.Type = "article"
+	apiresponse := APIResponse{Scheme: "doi", DOI: "10.1234/abc", HTTPStatus: "200 OK"}
+	apiresponse.Doi = "10.1234/abc"
+	apiresponse.IsOa = true
+	record.APIResponses = []APIResponse{apiresponse}
+
+	rows, err := csv.NewReader(runProcessOutput(&Processor{}, record)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("processOutput wrote %d rows, want 2", len(rows))
+	}
+	if rows[0][0] != "Artudis - ID" || rows[1][0] != "pub1" || rows[1][6] != "10.1234/abc" {
+		t.Errorf("processOutput wrote %v", rows)
+	}
+}
+
+func TestProcessOutputOrdered(t *testing.T) {
+	var records []Record
+	for _, line := range []int{3, 1, 5, 2, 4, 6} {
+		var record Record
+		record.ID = strconv.Itoa(line)
+		record.Line = line
+		record.omitted = line == 4
+		record.APIResponses = []APIResponse{{DOI: "10.1234/abc", HTTPStatus: "200 OK"}}
+		records = append(records, record)
+	}
+
+	rows, err := csv.NewReader(runProcessOutput(&Processor{Ordered: true}, records...)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, row := range rows[1:] {
+		ids = append(ids, row[0])
+	}
+	if want := []string{"1", "2", "3", "5", "6"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("processOutput in ordered mode wrote %v, want %v", ids, want)
+	}
+}
+
+func TestProcessOutputNotOADOIs(t *testing.T) {
+	closed := APIResponse{DOI: "10.1234/Closed", HTTPStatus: "200 OK"}
+	closed.Doi = "10.1234/closed"
+	open := APIResponse{DOI: "10.1234/open", HTTPStatus: "200 OK"}
+	open.Doi, open.IsOa = "10.1234/open", true
+	notFound := APIResponse{DOI: "10.1234/missing", HTTPStatus: "404 Not Found"}
+	failed := APIResponse{DOI: "10.1234/failed", GETError: "connection refused"}
+	again := closed
+	again.DOI = "https://doi.org/10.1234/closed"
+
+	var notOA bytes.Buffer
+	runProcessOutput(&Processor{NotOADOIs: &notOA},
+		Record{APIResponses: []APIResponse{closed, open}},
+		Record{APIResponses: []APIResponse{notFound, failed}},
+		Record{APIResponses: []APIResponse{again}},
+	)
+	if want := "10.1234/closed\n"; notOA.String() != want {
+		t.Errorf("processOutput with NotOADOIs wrote %q, want %q", notOA.String(), want)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that can be read while another goroutine
+// writes to it.
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestProcessOutputFlushInterval(t *testing.T) {
+	var record Record
+	record.ID = "pub1"
+
+	var buf lockedBuffer
+	w, _ := NewRecordWriter("csv", &buf, WriterOptions{Columns: []string{"id"}, NoHeader: true})
+	output := make(chan Record)
+	var waitgroupOutput sync.WaitGroup
+	waitgroupOutput.Add(1)
+	go (&Processor{FlushInterval: time.Millisecond}).processOutput(output, w, &waitgroupOutput)
+	defer waitgroupOutput.Wait()
+	defer close(output)
+
+	output <- record
+	deadline := time.Now().Add(5 * time.Second)
+	for buf.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if buf.String() != "pub1\n" {
+		t.Errorf("processOutput with FlushInterval wrote %q before the output was closed, want %q", buf.String(), "pub1\n")
+	}
+}
+
+func TestProcessReader(t *testing.T) {
+	client, _ := newTestAPI(t, 200)
+	processor := &Processor{Client: client, Format: "csv", Ordered: true}
+
+	input := strings.Join([]string{
+		`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+		`not json`,
+		`{"__id__": "2", "identifier": [{"scheme": "isbn", "value": "123"}]}`,
+		`{"__id__": "3", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}, {"scheme": "doi", "value": "10.1234/abc"}]}`,
+		`{"__id__": "4", "identifier": [{"scheme": "DOI", "value": "10.1234/abc"}]}`,
+	}, "\n")
+
+	var buf bytes.Buffer
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, row := range rows[1:] {
+		ids = append(ids, row[0])
+	}
+	if want := []string{"1", "2", "3", "4"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ProcessReader wrote rows for %v, want %v", ids, want)
+	}
+}
+
+func TestProcessReaderErrors(t *testing.T) {
+	client, _ := newTestAPI(t, 404)
+	var errors bytes.Buffer
+	processor := &Processor{Client: client, Format: "csv", Errors: &errors, WriterOptions: WriterOptions{Columns: []string{"id", "status"}}}
+
+	input := strings.Join([]string{
+		`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+		`{"__id__": "2"}`,
+	}, "\n")
+
+	var buf bytes.Buffer
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	want := "Artudis - ID,API - Status\n1,not-found\n"
+	if err != nil || errors.String() != want || strings.Count(buf.String(), "\n") != 3 {
+		t.Errorf("ProcessReader wrote errors %q, %v, want %q", errors.String(), err, want)
+	}
+}
+
+func TestProcessReaderWebhook(t *testing.T) {
+	var testTable = []struct {
+		status  int
+		batches []int
+		errors  string
+	}{
+		{http.StatusOK, []int{2, 1}, "Artudis - ID\n"},
+		{http.StatusBadRequest, []int{2, 1}, "Artudis - ID\n1\n2\n3\n"},
+	}
+
+	for _, tt := range testTable {
+		var batches []int
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var records []Record
+			err := json.NewDecoder(r.Body).Decode(&records)
+			if err != nil || r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("webhook got %s %s, %v", r.Method, r.Header.Get("Content-Type"), err)
+			}
+			batches = append(batches, len(records))
+			w.WriteHeader(tt.status)
+		}))
+		defer webhook.Close()
+
+		client, _ := newTestAPI(t, 200)
+		var errors bytes.Buffer
+		processor := &Processor{Client: client, Format: "csv", Ordered: true, Errors: &errors, WriterOptions: WriterOptions{Columns: []string{"id"}},
+			WebhookURL: webhook.URL, WebhookBatchSize: 2, WebhookErrors: true}
+
+		input := strings.Join([]string{`{"__id__": "1"}`, `{"__id__": "2"}`, `{"__id__": "3"}`}, "\n")
+		err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &bytes.Buffer{})
+		if err != nil || !reflect.DeepEqual(batches, tt.batches) || errors.String() != tt.errors {
+			t.Errorf("ProcessReader with a webhook answering %v => batches %v, errors %q, %v, want %v, %q",
+				tt.status, batches, errors.String(), err, tt.batches, tt.errors)
+		}
+	}
+}
+
+func TestPostWebhookThrottled(t *testing.T) {
+	requests := 0
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer webhook.Close()
+
+	// newTestAPI shortens the backoff; a Retry-After of 0 must not skip it.
+	client, _ := newTestAPI(t, 200)
+	client.MaxRetryWait = 50 * time.Millisecond
+
+	err := client.postWebhook(context.Background(), webhook.URL, []byte("[]"))
+	if err == nil || requests > 10 {
+		t.Errorf("postWebhook to a webhook always answering 429 with Retry-After: 0 => %d requests, %v, want at most 10, an error", requests, err)
+	}
+}
+
+func TestProcessReaderDeadline(t *testing.T) {
+	// The API answers too late for the deadline, which passes while both
+	// lookups are in flight.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte(`{"doi": "10.1234/abc", "is_oa": true}`))
+	}))
+	defer server.Close()
+
+	client := NewClient("someone@example.com", 2)
+	client.BaseURL = server.URL + "/"
+	var deadLetter bytes.Buffer
+	processor := &Processor{Client: client, Format: "csv", DeadLetter: &deadLetter, Strict: true,
+		WriterOptions: WriterOptions{Columns: []string{"id", "status"}, NoHeader: true}}
+
+	input := `{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}
+{"__id__": "2", "identifier": [{"scheme": "doi", "value": "10.1234/def"}]}`
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var buf bytes.Buffer
+	err := processor.ProcessReader(ctx, "test", strings.NewReader(input), &buf)
+
+	// The lookups are left out as unfinished, not reported as timeouts.
+	total := processor.Total()
+	if err != nil || buf.String() != "" || deadLetter.String() != "" || total.Failed != 0 || total.GETErrors != 0 {
+		t.Errorf("ProcessReader past its deadline => %q, dead letters %q, %d failed, %d GET errors, %v, want no rows or errors",
+			buf.String(), deadLetter.String(), total.Failed, total.GETErrors, err)
+	}
+}
+
+func TestProcessReaderRejects(t *testing.T) {
+	client, _ := newTestAPI(t, 200)
+	var rejects bytes.Buffer
+	processor := &Processor{Client: client, Format: "csv", Rejects: &rejects}
+
+	input := strings.Join([]string{
+		`{"__id__": "1"}`,
+		`{"__id__": `,
+		`not json`,
+	}, "\n")
+
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &bytes.Buffer{})
+	want := "{\"__id__\": \nnot json\n"
+	if err != nil || rejects.String() != want {
+		t.Errorf("ProcessReader rejected %q, %v, want %q", rejects.String(), err, want)
+	}
+}
+
+func TestProcessReaderConcurrentDOIs(t *testing.T) {
+	// The first DOI is answered last, so the responses complete in reverse.
+	delays := map[string]time.Duration{"a": 150 * time.Millisecond, "b": 100 * time.Millisecond, "c": 50 * time.Millisecond}
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+
+		doi := strings.TrimPrefix(r.URL.Path, "/")
+		time.Sleep(delays[path.Base(doi)])
+		fmt.Fprintf(w, `{"doi": %q}`, doi)
+
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	client := NewClient("someone@example.com", 3)
+	client.BaseURL = server.URL + "/"
+	processor := &Processor{Client: client, Format: "csv", Workers: 1, WriterOptions: WriterOptions{Columns: []string{"doi"}, NoHeader: true}}
+
+	input := `{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/a"}, {"scheme": "doi", "value": "10.1234/b"}, {"scheme": "doi", "value": "10.1234/c"}]}`
+	var buf bytes.Buffer
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	if want := "10.1234/a\n10.1234/b\n10.1234/c\n"; err != nil || buf.String() != want || maxInFlight != 3 {
+		t.Errorf("ProcessReader with three DOIs => %q, %v with %d requests at once, want %q with 3", buf.String(), err, maxInFlight, want)
+	}
+}
+
+func TestProcessReaderDedupe(t *testing.T) {
+	input := strings.Join([]string{
+		`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+		`{"__id__": "2", "identifier": [{"scheme": "doi", "value": "https://doi.org/10.1234/ABC"}]}`,
+		`{"__id__": "3", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+	}, "\n")
+
+	testTable := []struct {
+		dedupe   bool
+		requests int
+	}{
+		{false, 3},
+		{true, 1},
+	}
+
+	for _, tt := range testTable {
+		client, requests := newTestAPI(t, 200)
+		processor := &Processor{Client: client, Format: "csv", Dedupe: tt.dedupe, Progress: &Progress{}}
+
+		var buf bytes.Buffer
+		err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+		rows, _ := csv.NewReader(&buf).ReadAll()
+		if err != nil || *requests != tt.requests || len(rows) != 4 {
+			t.Errorf("ProcessReader with Dedupe %v => %d requests, %d rows, %v, want %d requests, 4 rows",
+				tt.dedupe, *requests, len(rows), err, tt.requests)
+		}
+		records, lookups := processor.Progress.RecordsDone.Load(), processor.Progress.Lookups.Load()
+		if records != 3 || lookups != int64(tt.requests) {
+			t.Errorf("ProcessReader with Dedupe %v => progress of %d records, %d lookups, want 3 records, %d lookups",
+				tt.dedupe, records, lookups, tt.requests)
+		}
+	}
+}
+
+func TestProcessReaderBOMAndBlankLines(t *testing.T) {
+	file, err := os.Open("testdata/bom.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	client, _ := newTestAPI(t, 200)
+	processor := &Processor{Client: client, Format: "csv", WriterOptions: WriterOptions{Columns: []string{"id"}, NoHeader: true}}
+	var buf bytes.Buffer
+	err = processor.ProcessReader(context.Background(), "test", file, &buf)
+	total := processor.Total()
+	if err != nil || buf.String() != "pub1\npub2\n" || total.RejectedLines != 0 {
+		t.Errorf("ProcessReader of testdata/bom.ndjson => %q, %v with %d rejected lines, want %q with none",
+			buf.String(), err, total.RejectedLines, "pub1\npub2\n")
+	}
+}
+
+func TestProcessReaderComments(t *testing.T) {
+	testTable := []struct {
+		strict bool
+		output string
+		err    string
+	}{
+		{false, "pub1\npub2\npub3\n", ""},
+		{true, "pub1\npub2\n", "line 7 of test is not a valid publication"},
+	}
+
+	for _, tt := range testTable {
+		file, err := os.Open("testdata/comments.ndjson")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		client, _ := newTestAPI(t, 200)
+		processor := &Processor{Client: client, Format: "csv", Ordered: true, Strict: tt.strict, CommentPrefixes: []string{"//", "#"},
+			WriterOptions: WriterOptions{Columns: []string{"id"}, NoHeader: true}}
+		var buf bytes.Buffer
+		err = processor.ProcessReader(context.Background(), "test", file, &buf)
+		total := processor.Total()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) ||
+			buf.String() != tt.output || total.SkippedLines != 4 {
+			t.Errorf("ProcessReader of testdata/comments.ndjson with Strict %v => %q, %v with %d blank or comment lines, want %q, %q with 4",
+				tt.strict, buf.String(), err, total.SkippedLines, tt.output, tt.err)
+		}
+	}
+}
+
+func TestProcessReaderParsedRecords(t *testing.T) {
+	testTable := []struct {
+		input  string
+		parsed int
+	}{
+		{"", 0},
+		{"\n# comment\n", 0},
+		{`{"__id__": "1"`, 0},
+		{"not json\n{\"__id__\": \"1\"}", 1},
+		{"{\"__id__\": \"1\", \"type\": \"book\"}\n{\"__id__\": \"2\", \"type\": \"article\"}", 2},
+	}
+
+	for _, tt := range testTable {
+		processor := &Processor{Client: NewClient("someone@example.com", 1), Format: "csv", CommentPrefixes: []string{"#"}, Types: []string{"article"}}
+		err := processor.ProcessReader(context.Background(), "test", strings.NewReader(tt.input), &bytes.Buffer{})
+		if parsed := processor.Total().ParsedRecords; err != nil || parsed != tt.parsed {
+			t.Errorf("ProcessReader(%q) => %d parsed records, %v, want %d", tt.input, parsed, err, tt.parsed)
+		}
+	}
+}
+
+func TestProcessReaderDryRun(t *testing.T) {
+	client, requests := newTestAPI(t, 200)
+	processor := &Processor{Client: client, Format: "csv", DryRun: true, WriterOptions: WriterOptions{Columns: []string{"id", "status"}}}
+
+	input := `{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`
+	var buf bytes.Buffer
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	want := "Artudis - ID,API - Status\n1,skipped\n"
+	if err != nil || *requests != 0 || buf.String() != want {
+		t.Errorf("ProcessReader with DryRun => %q, %v after %d requests, want %q after 0", buf.String(), err, *requests, want)
+	}
+}
+
+func TestProcessReaderPrintURLs(t *testing.T) {
+	client, requests := newTestAPI(t, 200)
+	client.BaseURL = "https://gateway.example.com/lookup"
+	client.DOIParam = "doi"
+	client.Email = "someone+oa@example.com"
+	var urls bytes.Buffer
+	processor := &Processor{Client: client, Format: "csv", PrintURLs: &urls, WriterOptions: WriterOptions{Columns: []string{"id", "status"}}}
+
+	input := `{"__id__": "1", "identifier": [{"scheme": "doi", "value": "https://doi.org/10.1234/A&b"}]}`
+	var buf bytes.Buffer
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	wantURLs := "https://gateway.example.com/lookup?doi=10.1234%2Fa%26b&email=someone%2Boa%40example.com\n"
+	want := "Artudis - ID,API - Status\n1,skipped\n"
+	if err != nil || *requests != 0 || urls.String() != wantURLs || buf.String() != want {
+		t.Errorf("ProcessReader with PrintURLs => %q, %q, %v after %d requests, want %q, %q after 0", urls.String(), buf.String(), err, *requests, wantURLs, want)
+	}
+}
+
+// panickingTransport answers every request like oaDOI, except those for
+// DOIs containing "panic", which it panics on, as a bug set off by a
+// malformed response might.
+type panickingTransport struct{}
+
+func (panickingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.Contains(req.URL.Path, "panic") {
+		panic("malformed response")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"doi": "10.1234/abc", "is_oa": true}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestProcessReaderRecoverPanics(t *testing.T) {
+	input := `{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}
+{"__id__": "2", "identifier": [{"scheme": "doi", "value": "10.1234/panic"}]}
+{"__id__": "3", "identifier": [{"scheme": "doi", "value": "10.1234/def"}, {"scheme": "doi", "value": "10.1234/ghi"}]}
+{"__id__": "4", "identifier": [{"scheme": "doi", "value": "10.1234/PANIC"}]}
+`
+
+	// Rows are sorted, as without Ordered they're written in any order.
+	testTable := []struct {
+		ordered bool
+		dedupe  bool
+		panics  int
+		outputs []string
+	}{
+		{false, false, 2, []string{"1,ok\n3,ok\n3,ok\n"}},
+		{true, false, 2, []string{"1,ok\n3,ok\n3,ok\n"}},
+		// Whichever of records 2 and 4 looks up the DOI first panics, and
+		// the other gets an error rather than waiting for it forever.
+		{false, true, 1, []string{"1,ok\n2,network-error\n3,ok\n3,ok\n", "1,ok\n3,ok\n3,ok\n4,network-error\n"}},
+	}
+
+	for _, tt := range testTable {
+		client := NewClient("someone@example.com", 2)
+		client.BaseURL = "http://oadoi.test/"
+		client.HTTPClient = &http.Client{Transport: panickingTransport{}}
+		client.Retries = 0
+		processor := &Processor{Client: client, Format: "csv", Ordered: tt.ordered, Dedupe: tt.dedupe, RecoverPanics: true,
+			WriterOptions: WriterOptions{Columns: []string{"id", "status"}, NoHeader: true}}
+
+		var buf bytes.Buffer
+		err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+		rows := strings.SplitAfter(buf.String(), "\n")
+		sort.Strings(rows)
+		output := strings.Join(rows, "")
+		panics := processor.Total().Panics
+		if err != nil || panics != tt.panics || !slices.Contains(tt.outputs, output) {
+			t.Errorf("ProcessReader(ordered %v, dedupe %v) => %q, %d panics, %v, want one of %q, %d", tt.ordered, tt.dedupe, output, panics, err, tt.outputs, tt.panics)
+		}
+	}
+}
+
+func TestProcessReaderLedger(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "ledger.jsonl")
+	// A line cut short by a crash is skipped, and new entries start after it.
+	os.WriteFile(fileName, []byte(`{"doi": "10.1234/partial", "resp`), 0644)
+
+	input := `{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`
+	testTable := []struct {
+		entries  int
+		requests int
+	}{
+		{0, 1},
+		{1, 0},
+	}
+
+	for _, tt := range testTable {
+		ledger, err := OpenLedger(fileName)
+		if err != nil || ledger.Len() != tt.entries {
+			t.Fatalf("OpenLedger => %v, %v, want %d entries", ledger, err, tt.entries)
+		}
+
+		client, requests := newTestAPI(t, 200)
+		processor := &Processor{Client: client, Format: "csv", Ledger: ledger, WriterOptions: WriterOptions{Columns: []string{"id", "status", "api_oa"}, NoHeader: true}}
+		var buf bytes.Buffer
+		err = processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+		ledger.Close()
+		if err != nil || *requests != tt.requests || buf.String() != "1,ok,true\n" {
+			t.Errorf("ProcessReader with a ledger of %d entries => %q, %v after %d requests, want %q after %d",
+				tt.entries, buf.String(), err, *requests, "1,ok,true\n", tt.requests)
+		}
+	}
+}
+
+func TestProcessReaderSkipOA(t *testing.T) {
+	client, requests := newTestAPI(t, 200)
+	processor := &Processor{Client: client, Format: "csv", SkipOA: true, WriterOptions: WriterOptions{Columns: []string{"id"}, NoHeader: true}}
+
+	input := strings.Join([]string{
+		`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}], "attachment": [{"open_access": "true", "type": "other"}]}`,
+		`{"__id__": "2", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}], "attachment": [{"open_access": "false", "type": "other"}]}`,
+	}, "\n")
+
+	var buf bytes.Buffer
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	if err != nil || *requests != 1 || buf.String() != "2\n" {
+		t.Errorf("ProcessReader with SkipOA => %q, %v after %d requests, want %q after 1", buf.String(), err, *requests, "2\n")
+	}
+}
+
+func TestProcessReaderOnlyMismatches(t *testing.T) {
+	client, _ := newTestAPI(t, 200)
+	processor := &Processor{Client: client, Format: "csv", OnlyMismatches: true, WriterOptions: WriterOptions{Columns: []string{"id"}, NoHeader: true}}
+
+	input := strings.Join([]string{
+		`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}], "attachment": [{"open_access": "true", "type": "other"}]}`,
+		`{"__id__": "2", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}], "attachment": [{"open_access": "false", "type": "other"}]}`,
+		`{"__id__": "3"}`,
+	}, "\n")
+
+	var buf bytes.Buffer
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	total := processor.Total()
+	if err != nil || buf.String() != "2\n" || total.Records != 3 || total.OAMismatches != 1 {
+		t.Errorf("ProcessReader with OnlyMismatches => %q, %v, %d records, %d mismatches, want %q, 3 records, 1 mismatch",
+			buf.String(), err, total.Records, total.OAMismatches, "2\n")
+	}
+}
+
+func TestProcessReaderChangesOnly(t *testing.T) {
+	baseline, err := readBaseline(strings.NewReader("id,identifier_value,api_oa\n1,10.1234/abc,true\n2,10.1234/abc,false\n3,,false\n"), ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := newTestAPI(t, 200)
+	processor := &Processor{Client: client, Format: "csv", Ordered: true, ChangesOnly: true,
+		WriterOptions: WriterOptions{Columns: []string{"id", "baseline_change"}, NoHeader: true, Baseline: baseline}}
+
+	input := strings.Join([]string{
+		`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+		`{"__id__": "2", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+		`{"__id__": "3"}`,
+		`{"__id__": "4"}`,
+	}, "\n")
+
+	var buf bytes.Buffer
+	err = processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	want := "2,changed\n4,new\n"
+	if err != nil || buf.String() != want || processor.Total().Records != 4 {
+		t.Errorf("ProcessReader with ChangesOnly => %q, %v, %d records, want %q, 4 records", buf.String(), err, processor.Total().Records, want)
+	}
+}
+
+func TestProcessReaderSample(t *testing.T) {
+	client, requests := newTestAPI(t, 200)
+	processor := &Processor{Client: client, Format: "csv", Sample: 2, CommentPrefixes: []string{"#"}, WriterOptions: WriterOptions{Columns: []string{"id"}, NoHeader: true}}
+
+	// Blank and comment lines don't count towards the sample.
+	input := strings.Join([]string{
+		``,
+		`# export of 2024-03-01`,
+		`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+		`   `,
+		`{"__id__": "2", "identifier": [{"scheme": "doi", "value": "10.1234/def"}]}`,
+		`{"__id__": "3", "identifier": [{"scheme": "doi", "value": "10.1234/ghi"}]}`,
+	}, "\n")
+
+	var buf bytes.Buffer
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	if err != nil || *requests != 2 || buf.String() != "1\n2\n" {
+		t.Errorf("ProcessReader with Sample 2 => %q, %v after %d requests, want %q after 2", buf.String(), err, *requests, "1\n2\n")
+	}
+}
+
+func TestProcessReaderOutputBuffer(t *testing.T) {
+	// The records have no DOIs, so finish as fast as they can be written.
+	client := NewClient("someone@example.com", 4)
+	for _, ordered := range []bool{false, true} {
+		processor := &Processor{Client: client, Format: "csv", Ordered: ordered, OutputBuffer: 2, Workers: 4,
+			WriterOptions: WriterOptions{Columns: []string{"id"}, NoHeader: true}}
+
+		var lines []string
+		for i := 1; i <= 20; i++ {
+			lines = append(lines, fmt.Sprintf(`{"__id__": "%d"}`, i))
+		}
+
+		var buf bytes.Buffer
+		err := processor.ProcessReader(context.Background(), "test", strings.NewReader(strings.Join(lines, "\n")), &buf)
+		ids := strings.Fields(buf.String())
+		if err != nil || len(ids) != 20 || (ordered && strings.Join(ids, ",") != "1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20") {
+			t.Errorf("ProcessReader with OutputBuffer 2, ordered %v => %v, %v, want all 20 records", ordered, ids, err)
+		}
+	}
+}
+
+func TestProcessReaderTypes(t *testing.T) {
+	client, requests := newTestAPI(t, 200)
+	processor := &Processor{Client: client, Format: "csv", Types: []string{"Article", "dataset"}, WriterOptions: WriterOptions{Columns: []string{"id"}, NoHeader: true}}
+
+	input := strings.Join([]string{
+		`{"__id__": "1", "type": "article", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+		`{"__id__": "2", "type": "book", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+		`{"__id__": "3", "type": "Dataset", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`,
+	}, "\n")
+
+	var buf bytes.Buffer
+	err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+	if err != nil || *requests != 2 || buf.String() != "1\n3\n" {
+		t.Errorf("ProcessReader with Types => %q, %v after %d requests, want %q after 2", buf.String(), err, *requests, "1\n3\n")
+	}
+}
+
+func TestProcessReaderLookupSchemes(t *testing.T) {
+	input := `{"__id__": "1", "identifier": [{"scheme": "DOI", "value": "10.1234/abc"}, {"scheme": "handle", "value": "10.1234/def"}]}`
+
+	testTable := []struct {
+		schemes  []string
+		requests int
+	}{
+		{nil, 1},
+		{[]string{"handle"}, 1},
+		{[]string{"doi", "Handle"}, 2},
+		{[]string{"pmid"}, 0},
+	}
+
+	for _, tt := range testTable {
+		client, requests := newTestAPI(t, 200)
+		processor := &Processor{Client: client, Format: "csv", LookupSchemes: tt.schemes}
+
+		err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &bytes.Buffer{})
+		if err != nil || *requests != tt.requests {
+			t.Errorf("ProcessReader with LookupSchemes %v => %d requests, %v, want %d requests", tt.schemes, *requests, err, tt.requests)
+		}
+	}
+}
+
+func TestProcessReaderStrict(t *testing.T) {
+	testTable := []struct {
+		input  string
+		status int
+		valid  bool
+	}{
+		{`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`, 200, true},
+		{`{"__id__": "1", "identifier": "10.1234/abc"}`, 200, false},
+		{`{"__id__": "1", `, 200, false},
+		{`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`, 404, false},
+		{`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/abc"}]}`, 500, false},
+	}
+
+	for _, tt := range testTable {
+		client, _ := newTestAPI(t, tt.status)
+		client.Retries = 0
+		processor := &Processor{Client: client, Format: "csv", Strict: true}
+
+		err := processor.ProcessReader(context.Background(), "test", strings.NewReader(tt.input), &bytes.Buffer{})
+		if (err == nil) != tt.valid {
+			t.Errorf("ProcessReader in strict mode of %s with status %d => %v, want valid %v", tt.input, tt.status, err, tt.valid)
+		}
+	}
+}
+
+func TestFilterYears(t *testing.T) {
+	var record Record
+	for _, year := range []int{0, 2009, 2010, 2015, 2020, 2021} {
+		var apiresponse APIResponse
+		apiresponse.Year = year
+		record.APIResponses = append(record.APIResponses, apiresponse)
+	}
+
+	testTable := []struct {
+		processor *Processor
+		years     []int
+	}{
+		{&Processor{}, []int{0, 2009, 2010, 2015, 2020, 2021}},
+		{&Processor{YearMin: 2010, YearMax: 2020}, []int{2010, 2015, 2020}},
+		{&Processor{YearMin: 2010, YearMax: 2020, IncludeUnknownYear: true}, []int{0, 2010, 2015, 2020}},
+		{&Processor{YearMax: 2009}, []int{2009}},
+		{&Processor{YearMin: 2030}, nil},
+	}
+
+	for _, tt := range testTable {
+		filtered, keep := tt.processor.filterYears(record)
+		var years []int
+		for _, apiresponse := range filtered.APIResponses {
+			years = append(years, apiresponse.Year)
+		}
+		if !reflect.DeepEqual(years, tt.years) || keep != (len(tt.years) > 0) {
+			t.Errorf("filterYears with %d-%d => %v, %v, want %v", tt.processor.YearMin, tt.processor.YearMax, years, keep, tt.years)
+		}
+	}
+}
+
+func TestFilterDataStandard(t *testing.T) {
+	var record Record
+	for _, dataStandard := range []int{1, 2, 0} {
+		apiresponse := APIResponse{DOI: "10.1234/abc", HTTPStatus: "200 OK"}
+		apiresponse.Doi = "10.1234/abc"
+		apiresponse.DataStandard = dataStandard
+		record.APIResponses = append(record.APIResponses, apiresponse)
+	}
+	record.APIResponses = append(record.APIResponses, APIResponse{DOI: "10.1234/missing", HTTPStatus: "404 Not Found"})
+
+	testTable := []struct {
+		input           []APIResponse
+		minDataStandard int
+		dataStandards   []int
+	}{
+		{record.APIResponses, 0, []int{1, 2, 0, 0}},
+		{record.APIResponses, 2, []int{2, 0}},
+		{record.APIResponses[:2], 3, nil},
+		{nil, 2, nil},
+	}
+
+	for _, tt := range testTable {
+		processor := &Processor{MinDataStandard: tt.minDataStandard}
+		filtered, keep := processor.filterDataStandard(Record{APIResponses: tt.input})
+		var dataStandards []int
+		for _, apiresponse := range filtered.APIResponses {
+			dataStandards = append(dataStandards, apiresponse.DataStandard)
+		}
+		if !reflect.DeepEqual(dataStandards, tt.dataStandards) || keep != (len(tt.dataStandards) > 0 || len(tt.input) == 0) {
+			t.Errorf("filterDataStandard of %d responses with %d => %v, %v, want %v",
+				len(tt.input), tt.minDataStandard, dataStandards, keep, tt.dataStandards)
+		}
+	}
+
+	processor := &Processor{MinDataStandard: 2}
+	runProcessOutput(processor, record)
+	if total := processor.Total(); total.BelowDataStandard != 2 || total.Records != 1 {
+		t.Errorf("processOutput with MinDataStandard 2 => %d records, %d below the data standard, want 1, 2", total.Records, total.BelowDataStandard)
+	}
+}
+
+func TestProcessReaderMaxConsecutiveErrors(t *testing.T) {
+	input := strings.Join([]string{
+		`{"__id__": "1", "identifier": [{"scheme": "doi", "value": "10.1234/a"}]}`,
+		`{"__id__": "2", "identifier": [{"scheme": "doi", "value": "10.1234/b"}]}`,
+		`{"__id__": "3", "identifier": [{"scheme": "doi", "value": "10.1234/c"}]}`,
+		`{"__id__": "4", "identifier": [{"scheme": "doi", "value": "10.1234/d"}]}`,
+	}, "\n")
+
+	testTable := []struct {
+		statuses []int
+		max      int
+		failed   bool
+	}{
+		{[]int{500}, 0, false},
+		{[]int{500}, 5, false},
+		{[]int{500}, 2, true},
+		{[]int{500, 200, 500, 200}, 2, false},
+		{[]int{404}, 2, false},
+	}
+
+	for _, tt := range testTable {
+		client, _ := newTestAPI(t, tt.statuses...)
+		client.Retries = 0
+		processor := &Processor{Client: client, Format: "csv", Workers: 1, MaxConsecutiveErrors: tt.max}
+
+		var buf bytes.Buffer
+		err := processor.ProcessReader(context.Background(), "test", strings.NewReader(input), &buf)
+		if (err != nil) != tt.failed {
+			t.Errorf("ProcessReader with statuses %v and MaxConsecutiveErrors %d => %v, want failed %v", tt.statuses, tt.max, err, tt.failed)
+		}
+	}
+}
+
+func TestPrimaryResponse(t *testing.T) {
+	closed := APIResponse{DOI: "10.1234/closed", HTTPStatus: "200 OK"}
+	open := APIResponse{DOI: "10.1234/open", HTTPStatus: "200 OK"}
+	open.IsOa = true
+	failed := APIResponse{DOI: "10.1234/failed", GETError: "connection refused"}
+	failed.IsOa = true
+
+	testTable := []struct {
+		input  []APIResponse
+		output string
+	}{
+		{[]APIResponse{closed}, "10.1234/closed"},
+		{[]APIResponse{closed, open}, "10.1234/open"},
+		{[]APIResponse{open, closed}, "10.1234/open"},
+		{[]APIResponse{failed, closed}, "10.1234/failed"},
+		{[]APIResponse{failed, closed, open}, "10.1234/open"},
+	}
+
+	for _, tt := range testTable {
+		realOutput := primaryResponse(tt.input).DOI
+		if realOutput != tt.output {
+			t.Errorf("primaryResponse(%v) => %v, want %v", tt.input, realOutput, tt.output)
+		}
+	}
+}
+
+func TestAggregateResponses(t *testing.T) {
+	closed := APIResponse{DOI: "10.1234/closed", HTTPStatus: "200 OK"}
+	accepted := APIResponse{DOI: "10.1234/accepted", HTTPStatus: "200 OK"}
+	accepted.IsOa = true
+	accepted.BestOaLocation.Version = "acceptedVersion"
+	published := APIResponse{DOI: "10.1234/published", HTTPStatus: "200 OK"}
+	published.IsOa = true
+	published.BestOaLocation.Version = "publishedVersion"
+	failed := APIResponse{DOI: "10.1234/failed", GETError: "connection refused"}
+	failed.IsOa = true
+	failed.BestOaLocation.Version = "publishedVersion"
+
+	testTable := []struct {
+		input  []APIResponse
+		doi    string
+		isOa   bool
+		checks int
+	}{
+		{[]APIResponse{closed}, "10.1234/closed", false, 1},
+		{[]APIResponse{closed, accepted}, "10.1234/accepted", true, 2},
+		{[]APIResponse{accepted, published, closed}, "10.1234/published", true, 3},
+		{[]APIResponse{published, accepted}, "10.1234/published", true, 2},
+		{[]APIResponse{failed, closed}, "10.1234/closed", false, 2},
+		{[]APIResponse{failed, accepted}, "10.1234/accepted", true, 2},
+		{[]APIResponse{failed}, "10.1234/failed", true, 1},
+	}
+
+	for _, tt := range testTable {
+		realOutput := aggregateResponses(tt.input)
+		if realOutput.DOI != tt.doi || realOutput.IsOa != tt.isOa || realOutput.DOIsChecked != tt.checks {
+			t.Errorf("aggregateResponses(%v) => %v, %v, %d DOIs, want %v, %v, %d DOIs",
+				tt.input, realOutput.DOI, realOutput.IsOa, realOutput.DOIsChecked, tt.doi, tt.isOa, tt.checks)
+		}
+	}
+}
+
+func TestParseSortOrder(t *testing.T) {
+	testTable := []struct {
+		input  string
+		output SortOrder
+		ok     bool
+	}{
+		{"id", SortOrder{Key: "id"}, true},
+		{"year:asc", SortOrder{Key: "year"}, true},
+		{"api_oa:desc", SortOrder{Key: "api_oa", Descending: true}, true},
+		{"title", SortOrder{}, false},
+		{"type:down", SortOrder{}, false},
+	}
+
+	for _, tt := range testTable {
+		realOutput, err := ParseSortOrder(tt.input)
+		if (err == nil) != tt.ok || realOutput != tt.output {
+			t.Errorf("ParseSortOrder(%v) => %+v, %v, want %+v", tt.input, realOutput, err, tt.output)
+		}
+	}
+}
+
+func TestProcessOutputSort(t *testing.T) {
+	var records []Record
+	for i, id := range []string{"c", "a", "d", "b"} {
+		var record Record
+		record.Line = i + 1
+		record.ID = id
+		record.Type = map[string]string{"a": "book", "b": "article", "c": "book", "d": "article"}[id]
+		apiresponse := APIResponse{DOI: "10.1234/" + id, HTTPStatus: "200 OK"}
+		apiresponse.Year = map[string]int{"a": 2019, "b": 2021, "c": 0, "d": 2020}[id]
+		apiresponse.IsOa = id == "a" || id == "d"
+		record.APIResponses = []APIResponse{apiresponse}
+		records = append(records, record)
+	}
+
+	testTable := []struct {
+		sort   SortOrder
+		output []string
+	}{
+		{SortOrder{}, []string{"c", "a", "d", "b"}},
+		{SortOrder{Key: "id"}, []string{"a", "b", "c", "d"}},
+		{SortOrder{Key: "id", Descending: true}, []string{"d", "c", "b", "a"}},
+		{SortOrder{Key: "type"}, []string{"d", "b", "c", "a"}},
+		{SortOrder{Key: "api_oa", Descending: true}, []string{"a", "d", "c", "b"}},
+		{SortOrder{Key: "year"}, []string{"c", "a", "d", "b"}},
+	}
+
+	for _, tt := range testTable {
+		rows, _ := csv.NewReader(runProcessOutput(&Processor{Sort: tt.sort}, records...)).ReadAll()
+		var realOutput []string
+		for _, row := range rows[1:] {
+			realOutput = append(realOutput, row[0])
+		}
+		if !reflect.DeepEqual(realOutput, tt.output) {
+			t.Errorf("processOutput with Sort %+v => %v, want %v", tt.sort, realOutput, tt.output)
+		}
+	}
+}
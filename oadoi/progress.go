@@ -0,0 +1,60 @@
+package oadoi
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Progress counts records as a Processor works through its input. It is
+// updated from several goroutines, so every field is atomic.
+type Progress struct {
+	RecordsDone atomic.Int64
+	// Lookups counts completed DOI lookups, including cached ones.
+	Lookups   atomic.Int64
+	Errors    atomic.Int64
+	LinesRead atomic.Int64
+	BytesRead atomic.Int64
+	// TotalBytes is the size of the input, if known, and is set by the
+	// caller. It is used to estimate the total number of records.
+	TotalBytes atomic.Int64
+}
+
+type ProgressReport struct {
+	RecordsDone      int64   `json:"records_done"`
+	Lookups          int64   `json:"lookups"`
+	TotalEstimate    int64   `json:"total_estimate"`
+	RecordsPerSecond float64 `json:"records_per_second"`
+	Errors           int64   `json:"errors"`
+	ElapsedSeconds   float64 `json:"elapsed_seconds"`
+	ETASeconds       float64 `json:"eta_seconds"`
+}
+
+func (progress *Progress) Report(start, now time.Time) ProgressReport {
+	report := ProgressReport{
+		RecordsDone:    progress.RecordsDone.Load(),
+		Lookups:        progress.Lookups.Load(),
+		Errors:         progress.Errors.Load(),
+		ElapsedSeconds: now.Sub(start).Seconds(),
+	}
+
+	// The number of records is not known up front, so extrapolate from the
+	// average line length seen so far.
+	linesRead := progress.LinesRead.Load()
+	bytesRead := progress.BytesRead.Load()
+	totalBytes := progress.TotalBytes.Load()
+	if bytesRead > 0 && totalBytes > 0 {
+		report.TotalEstimate = linesRead * totalBytes / bytesRead
+	}
+	if report.TotalEstimate < linesRead {
+		report.TotalEstimate = linesRead
+	}
+
+	if report.ElapsedSeconds > 0 {
+		report.RecordsPerSecond = float64(report.RecordsDone) / report.ElapsedSeconds
+	}
+	if report.RecordsPerSecond > 0 && report.TotalEstimate > report.RecordsDone {
+		report.ETASeconds = float64(report.TotalEstimate-report.RecordsDone) / report.RecordsPerSecond
+	}
+
+	return report
+}
@@ -0,0 +1,201 @@
+package oadoi
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces out events so that no two are closer together than an
+// interval. Its zero value is ready to use.
+type rateLimiter struct {
+	mutex sync.Mutex
+	next  time.Time
+}
+
+// wait blocks until the next event may happen, or ctx is done.
+func (limiter *rateLimiter) wait(ctx context.Context, interval time.Duration) error {
+	limiter.mutex.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	delay := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(interval)
+	limiter.mutex.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// prefixLimiter limits how many requests run at a time for each DOI
+// registrant prefix, so that an export dominated by one publisher doesn't
+// send all its requests for that publisher at once. Its zero value is ready
+// to use.
+type prefixLimiter struct {
+	mutex   sync.Mutex
+	tickets map[string]chan bool
+}
+
+// acquire waits until fewer than limit requests are running for prefix. It
+// returns false, holding nothing, if ctx was done first; otherwise release
+// must be called once the request is finished.
+func (limiter *prefixLimiter) acquire(ctx context.Context, prefix string, limit int) (release func(), ok bool) {
+	limiter.mutex.Lock()
+	if limiter.tickets == nil {
+		limiter.tickets = map[string]chan bool{}
+	}
+	tickets, found := limiter.tickets[prefix]
+	if !found {
+		tickets = make(chan bool, limit)
+		limiter.tickets[prefix] = tickets
+	}
+	limiter.mutex.Unlock()
+
+	select {
+	case tickets <- true:
+	case <-ctx.Done():
+		return nil, false
+	}
+	return func() { <-tickets }, true
+}
+
+// adaptiveLimit runs fewer requests at a time than a client's tickets allow,
+// and tunes how many from how requests go: it adds one while a window of
+// requests succeeds without slowing down, takes one away after errors or
+// when latency doubles, and halves on a 429, so that a run settles at as
+// many as oaDOI will take. Lowering the limit takes tickets out of
+// circulation as requests finish, and raising it puts them back.
+type adaptiveLimit struct {
+	mutex    sync.Mutex
+	started  bool
+	min      int
+	max      int
+	limit    int
+	withheld int
+	// cooldown is how many more requests must finish before the limit may
+	// be lowered again, so that requests started under a higher limit
+	// don't lower it for the same reason twice.
+	cooldown int
+	// window counts the successful requests since the limit last changed,
+	// and latency adds up how long they took.
+	window  int
+	latency time.Duration
+	// baseline is the lowest average latency of a full window so far.
+	baseline time.Duration
+}
+
+// start sets the limit to min, withholding the tickets that are free; those
+// in use are withheld as they are released.
+func (limit *adaptiveLimit) start(tickets chan bool, lowest int) {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+
+	if limit.started {
+		return
+	}
+	limit.started = true
+	limit.max = cap(tickets)
+	limit.min = max(1, min(lowest, limit.max))
+	limit.limit = limit.min
+	limit.withhold(tickets)
+}
+
+// withhold takes free tickets out of circulation until the limit is met or
+// there are none left.
+func (limit *adaptiveLimit) withhold(tickets chan bool) {
+	for limit.withheld < limit.max-limit.limit {
+		select {
+		case <-tickets:
+			limit.withheld++
+		default:
+			return
+		}
+	}
+}
+
+// release returns a ticket to tickets, unless it is needed to lower the
+// number of requests running.
+func (limit *adaptiveLimit) release(tickets chan bool) {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+
+	if limit.withheld < limit.max-limit.limit {
+		limit.withheld++
+		return
+	}
+	tickets <- true
+}
+
+// observe records the outcome of a request, and changes the limit if it
+// calls for it.
+func (limit *adaptiveLimit) observe(tickets chan bool, status string, code int, latency time.Duration) {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+
+	if limit.cooldown > 0 {
+		limit.cooldown--
+	}
+
+	switch {
+	case code == http.StatusTooManyRequests:
+		limit.lower(tickets, limit.limit/2, "throttled")
+	case status == StatusNetworkError || status == StatusTimeout || status == StatusAPIError:
+		limit.lower(tickets, limit.limit-1, status)
+	default:
+		limit.window++
+		limit.latency += latency
+		if limit.window < limit.limit {
+			return
+		}
+		average := limit.latency / time.Duration(limit.window)
+		if limit.baseline == 0 || average < limit.baseline {
+			limit.baseline = average
+		}
+		if average > 2*limit.baseline {
+			limit.lower(tickets, limit.limit-1, "slow")
+		} else {
+			limit.set(tickets, limit.limit+1, "steady")
+		}
+	}
+}
+
+func (limit *adaptiveLimit) lower(tickets chan bool, to int, reason string) {
+	if limit.cooldown > 0 {
+		return
+	}
+	limit.cooldown = limit.limit
+	limit.set(tickets, to, reason)
+}
+
+// set changes the limit to to, within min and max, withholding free tickets
+// or putting back those no longer needed to hold it down, and starts a new
+// window.
+func (limit *adaptiveLimit) set(tickets chan bool, to int, reason string) {
+	limit.window = 0
+	limit.latency = 0
+
+	to = max(limit.min, min(to, limit.max))
+	if to == limit.limit {
+		return
+	}
+	limit.limit = to
+	limit.withhold(tickets)
+	for limit.withheld > limit.max-limit.limit {
+		limit.withheld--
+		tickets <- true
+	}
+	slog.Debug("Changed concurrency", "concurrency", limit.limit, "reason", reason)
+}
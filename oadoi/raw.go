@@ -0,0 +1,24 @@
+package oadoi
+
+import (
+	"log/slog"
+	"net/url"
+	"path/filepath"
+)
+
+// rawPath is where the body of the response for a DOI is archived in
+// RawDir: the normalized DOI, with its slashes and other characters that
+// can't be in a file name escaped as they would be in a URL path segment.
+func (client *Client) rawPath(doi string) string {
+	return filepath.Join(client.RawDir, url.PathEscape(NormalizeDOI(doi))+".json")
+}
+
+// writeRaw archives the body of a response, as oaDOI sent it. It is written
+// as cache entries are, so that concurrent lookups of a DOI don't
+// interleave; a failure is logged, and the lookup goes on.
+func (client *Client) writeRaw(doi string, body []byte) {
+	err := writeFileAtomic(client.rawPath(doi), body)
+	if err != nil {
+		slog.Error("Error writing raw response.", "doi", doi, "error", err)
+	}
+}
@@ -0,0 +1,142 @@
+package oadoi
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const SHERPAURI string = "https://www.sherpa.ac.uk/romeo/issn/"
+
+// SHERPAV2URI is the Sherpa Romeo v2 API endpoint for retrieving records.
+const SHERPAV2URI string = "https://v2.sherpa.ac.uk/cgi/retrieve"
+
+// MakeSherpaLink links each valid ISSN in a comma separated list to its
+// legacy Sherpa Romeo page under baseURL, normally SHERPAURI.
+func MakeSherpaLink(issns string, baseURL string) string {
+	sherpaLinks := []string{}
+	for _, issn := range parseISSNs(issns) {
+		sherpaLinks = append(sherpaLinks, baseURL+issn+"/")
+	}
+	return strings.Join(sherpaLinks, ",")
+}
+
+// MakeSherpaV2Link links each valid ISSN in a comma separated list to its
+// publication record in the Sherpa Romeo v2 API at baseURL, normally
+// SHERPAV2URI, which needs an API key.
+func MakeSherpaV2Link(issns string, apiKey string, baseURL string) string {
+	sherpaLinks := []string{}
+	for _, issn := range parseISSNs(issns) {
+		query := url.Values{}
+		query.Set("item-type", "publication")
+		query.Set("format", "Json")
+		query.Set("api-key", apiKey)
+		query.Set("filter", `[["issn","equals","`+issn+`"]]`)
+		sherpaLinks = append(sherpaLinks, baseURL+"?"+query.Encode())
+	}
+	return strings.Join(sherpaLinks, ",")
+}
+
+// ISSNs is a comma separated list of valid ISSNs, hyphenated, sorted and
+// without duplicates, as parseISSNs returns them. oaDOI usually gives
+// journal_issns as such a list, but not always: some records have the
+// ISSNs separated by semicolons or spaces, spaces around or instead of the
+// hyphen, no hyphen, or an ISSN as a number, or a list of ISSNs as an
+// array. All of these are decoded into the usual form, leaving out
+// anything that isn't a valid ISSN.
+type ISSNs string
+
+// issnDashes are the hyphen, and dashes that are mistaken for it.
+const issnDashes = "-‐‑–—"
+
+// issnPattern matches an ISSN written with or without a hyphen, or a dash
+// in place of it, and spaces around it.
+var issnPattern = regexp.MustCompile(`[0-9]{4} *[` + issnDashes + `]? *[0-9]{3}[0-9Xx]`)
+
+func (issns *ISSNs) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return err
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+
+	var found []string
+	for _, value := range values {
+		switch value := value.(type) {
+		case string:
+			found = append(found, issnPattern.FindAllString(value, -1)...)
+		case json.Number:
+			// A number has lost the leading zeros of the ISSN.
+			issn := value.String()
+			if len(issn) < 8 {
+				issn = strings.Repeat("0", 8-len(issn)) + issn
+			}
+			found = append(found, issn)
+		}
+	}
+	*issns = ISSNs(strings.Join(parseISSNs(strings.Join(found, ",")), ","))
+	return nil
+}
+
+// sherpaISSNs are the ISSNs to link to Sherpa: the journal's, or its
+// linking ISSN if oaDOI gives only that.
+func (body APIResponseBody) sherpaISSNs() string {
+	if body.JournalIssns == "" {
+		return string(body.JournalIssnL)
+	}
+	return string(body.JournalIssns)
+}
+
+// parseISSNs returns the valid ISSNs in a comma separated list, in the
+// hyphenated form, sorted and without duplicates. Missing hyphens are added,
+// and spaces or dashes in place of them replaced; anything else is skipped.
+func parseISSNs(issns string) []string {
+	var valid []string
+	seen := map[string]bool{}
+	for _, issn := range strings.Split(issns, ",") {
+		issn = strings.ToUpper(strings.TrimSpace(issn))
+		if rest := strings.TrimLeft(issn[min(4, len(issn)):], " "+issnDashes); len(rest) == 4 {
+			issn = issn[0:4] + rest
+		}
+		if validISSN(issn) {
+			issn = issn[0:4] + "-" + issn[4:8]
+			if !seen[issn] {
+				seen[issn] = true
+				valid = append(valid, issn)
+			}
+		}
+	}
+	sort.Strings(valid)
+	return valid
+}
+
+// validISSN checks an ISSN without its hyphen: seven digits followed by a
+// mod-11 check digit, where X stands for 10.
+func validISSN(issn string) bool {
+	if len(issn) != 8 {
+		return false
+	}
+
+	sum := 0
+	for i := 0; i < 7; i++ {
+		if issn[i] < '0' || issn[i] > '9' {
+			return false
+		}
+		sum += int(issn[i]-'0') * (8 - i)
+	}
+
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return issn[7] == 'X'
+	}
+	return int(issn[7]-'0') == check
+}
@@ -0,0 +1,97 @@
+package oadoi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Snapshot answers lookups from an Unpaywall data snapshot: a JSONL file
+// with one API response body per line. The snapshot is too big to hold in
+// memory, so only an index from DOI to line offset is kept and lines are
+// read as they are needed.
+type Snapshot struct {
+	file  *os.File
+	index map[string]int64
+}
+
+// OpenSnapshot opens and indexes a snapshot. The snapshot must be
+// uncompressed, since gzip can't be read from an offset.
+func OpenSnapshot(fileName string) (*Snapshot, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := indexSnapshot(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return &Snapshot{file: file, index: index}, nil
+}
+
+func indexSnapshot(r io.Reader) (map[string]int64, error) {
+	index := map[string]int64{}
+	buffered := bufio.NewReaderSize(r, 1<<20)
+
+	magic, _ := buffered.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return nil, errors.New("snapshot is gzipped, decompress it first")
+	}
+
+	var offset int64
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := buffered.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var body struct {
+				Doi string `json:"doi"`
+			}
+			if json.Unmarshal(line, &body) != nil || body.Doi == "" {
+				return nil, fmt.Errorf("line %d: not a snapshot record", lineNumber)
+			}
+			index[NormalizeDOI(body.Doi)] = offset
+		}
+		offset += int64(len(line))
+
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Len is the number of DOIs in the snapshot.
+func (snapshot *Snapshot) Len() int {
+	return len(snapshot.index)
+}
+
+// Lookup returns the snapshot record for a DOI, and whether there is one.
+// It is safe to call from several goroutines.
+func (snapshot *Snapshot) Lookup(doi string) (APIResponseBody, bool, error) {
+	var body APIResponseBody
+	offset, ok := snapshot.index[NormalizeDOI(doi)]
+	if !ok {
+		return body, false, nil
+	}
+
+	line, err := bufio.NewReader(io.NewSectionReader(snapshot.file, offset, 1<<62)).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return body, false, err
+	}
+	err = json.Unmarshal(line, &body)
+	if err != nil {
+		return body, false, err
+	}
+	return body, true, nil
+}
+
+func (snapshot *Snapshot) Close() error {
+	return snapshot.file.Close()
+}
@@ -0,0 +1,94 @@
+package oadoi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SortKeys are the columns a report can be sorted by.
+var SortKeys = []string{"id", "type", "api_oa", "year"}
+
+// A SortOrder sorts records by one of the SortKeys. The zero SortOrder
+// leaves records in the order they finish.
+type SortOrder struct {
+	Key        string
+	Descending bool
+}
+
+// ParseSortOrder parses a sort key, optionally followed by :asc or :desc.
+func ParseSortOrder(value string) (SortOrder, error) {
+	key, direction, _ := strings.Cut(value, ":")
+	order := SortOrder{Key: key}
+
+	switch direction {
+	case "", "asc":
+	case "desc":
+		order.Descending = true
+	default:
+		return SortOrder{}, fmt.Errorf("unknown sort direction %q, valid directions are asc and desc", direction)
+	}
+
+	for _, sortKey := range SortKeys {
+		if key == sortKey {
+			return order, nil
+		}
+	}
+	return SortOrder{}, fmt.Errorf("unknown sort key %q, valid keys are %s", key, strings.Join(SortKeys, ", "))
+}
+
+// less reports whether record a sorts before record b. Records with equal
+// keys stay in input order, so the report is the same from run to run.
+func (order SortOrder) less(a, b Record) bool {
+	compare := 0
+	switch order.Key {
+	case "id":
+		compare = strings.Compare(a.ID, b.ID)
+	case "type":
+		compare = strings.Compare(a.Type, b.Type)
+	case "api_oa":
+		compare = compareBool(apiOA(a), apiOA(b))
+	case "year":
+		compare = recordYear(a) - recordYear(b)
+	}
+	if order.Descending {
+		compare = -compare
+	}
+
+	if compare != 0 {
+		return compare < 0
+	}
+	return a.Line < b.Line
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// apiOA reports whether oaDOI has an open access copy for any of a record's
+// DOIs.
+func apiOA(record Record) bool {
+	for _, apiresponse := range record.APIResponses {
+		if apiresponse.IsOa {
+			return true
+		}
+	}
+	return false
+}
+
+// recordYear is the first year oaDOI gives for any of a record's DOIs, or 0
+// if there is none.
+func recordYear(record Record) int {
+	for _, apiresponse := range record.APIResponses {
+		if apiresponse.Year != 0 {
+			return apiresponse.Year
+		}
+	}
+	return 0
+}
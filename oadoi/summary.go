@@ -0,0 +1,215 @@
+package oadoi
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Summary counts what happened to the records written by a Processor.
+type Summary struct {
+	Records          int
+	RecordsWithDOI   int
+	APIOATrue        int
+	APIOAFalse       int
+	GETErrors        int
+	JSONDecodeErrors int
+	Non200Statuses   int
+	LookupsSaved     int
+	LookupsSkipped   int
+	// RejectedLines are input lines that could not be decoded, which are
+	// not counted as records.
+	RejectedLines int
+	// BelowDataStandard are API responses left out by MinDataStandard.
+	BelowDataStandard int
+	// SkippedLines are blank and comment lines, which are not records
+	// either.
+	SkippedLines int
+	// ParsedRecords are the lines decoded as records, including those left
+	// out of Records by SkipOA, Types or the year range.
+	ParsedRecords int
+	// SkippedOA are records left out because Artudis already has an open
+	// access copy.
+	SkippedOA int
+	// SkippedType are records left out because of their publication type.
+	SkippedType int
+	// Succeeded are lookups oaDOI answered, with a record or a 404.
+	// Failed are network errors, timeouts, other error statuses and
+	// undecodable responses.
+	Succeeded int
+	Failed    int
+	// ArtudisOATrue are records with an open access attachment in Artudis.
+	// OAMismatches are lookups where oaDOI disagrees with Artudis about
+	// there being an open access copy.
+	ArtudisOATrue int
+	OAMismatches  int
+	// QuotaExceeded are lookups not made because of the request quota.
+	QuotaExceeded int
+	// Panics are lines whose processing panicked and was recovered by
+	// RecoverPanics. They are left out of the report, and of Records.
+	Panics int
+	// StatusCodes counts the lookups that got an HTTP response by its
+	// status code, after any retries.
+	StatusCodes map[int]int
+	// GETErrorCategories counts GETErrors by their GETErrorCategory.
+	GETErrorCategories map[string]int
+}
+
+func (summary *Summary) Add(record Record) {
+	summary.Records++
+	summary.LookupsSaved += record.lookupsSaved
+	if len(record.APIResponses) > 0 {
+		summary.RecordsWithDOI++
+	}
+	artudisOA, _ := record.Publication.ArtudisOA(nil)
+	if artudisOA {
+		summary.ArtudisOATrue++
+	}
+
+	for _, apiresponse := range record.APIResponses {
+		if oaMismatch(artudisOA, apiresponse) {
+			summary.OAMismatches++
+		}
+		switch apiresponse.Status() {
+		case StatusOK, StatusNotFound:
+			summary.Succeeded++
+		case StatusNetworkError, StatusTimeout, StatusAPIError, StatusDecodeError:
+			summary.Failed++
+		}
+
+		if code := apiresponse.StatusCode(); code != 0 {
+			summary.addStatusCode(code, 1)
+		}
+
+		if apiresponse.Skipped {
+			summary.LookupsSkipped++
+			continue
+		}
+		if apiresponse.QuotaExceeded {
+			summary.QuotaExceeded++
+			continue
+		}
+		if apiresponse.GETError != "" {
+			summary.GETErrors++
+			if summary.GETErrorCategories == nil {
+				summary.GETErrorCategories = map[string]int{}
+			}
+			summary.GETErrorCategories[apiresponse.GETErrorCategory]++
+			continue
+		}
+		// Snapshot responses have no HTTP status; a DOI missing from the
+		// snapshot counts as a 404 would.
+		if apiresponse.FromSnapshot && apiresponse.Status() == StatusNotFound ||
+			!apiresponse.FromSnapshot && apiresponse.StatusCode() != http.StatusOK {
+			summary.Non200Statuses++
+			continue
+		}
+		if apiresponse.JSONDecodeError != "" {
+			summary.JSONDecodeErrors++
+			continue
+		}
+		if apiresponse.IsOa {
+			summary.APIOATrue++
+		} else {
+			summary.APIOAFalse++
+		}
+	}
+}
+
+// Merge adds the counts of another summary to this one.
+func (summary *Summary) Merge(other Summary) {
+	summary.Records += other.Records
+	summary.RecordsWithDOI += other.RecordsWithDOI
+	summary.APIOATrue += other.APIOATrue
+	summary.APIOAFalse += other.APIOAFalse
+	summary.GETErrors += other.GETErrors
+	summary.JSONDecodeErrors += other.JSONDecodeErrors
+	summary.Non200Statuses += other.Non200Statuses
+	summary.LookupsSaved += other.LookupsSaved
+	summary.LookupsSkipped += other.LookupsSkipped
+	summary.RejectedLines += other.RejectedLines
+	summary.SkippedLines += other.SkippedLines
+	summary.ParsedRecords += other.ParsedRecords
+	summary.BelowDataStandard += other.BelowDataStandard
+	summary.SkippedOA += other.SkippedOA
+	summary.SkippedType += other.SkippedType
+	summary.Succeeded += other.Succeeded
+	summary.Failed += other.Failed
+	summary.ArtudisOATrue += other.ArtudisOATrue
+	summary.OAMismatches += other.OAMismatches
+	summary.QuotaExceeded += other.QuotaExceeded
+	summary.Panics += other.Panics
+	for code, count := range other.StatusCodes {
+		summary.addStatusCode(code, count)
+	}
+	for category, count := range other.GETErrorCategories {
+		if summary.GETErrorCategories == nil {
+			summary.GETErrorCategories = map[string]int{}
+		}
+		summary.GETErrorCategories[category] += count
+	}
+}
+
+func (summary *Summary) addStatusCode(code int, count int) {
+	if summary.StatusCodes == nil {
+		summary.StatusCodes = map[int]int{}
+	}
+	summary.StatusCodes[code] += count
+}
+
+// StatusCodeString lists StatusCodes in order of code, as "200: 5, 404: 1".
+func (summary Summary) StatusCodeString() string {
+	codes := make([]int, 0, len(summary.StatusCodes))
+	for code := range summary.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	counts := make([]string, len(codes))
+	for i, code := range codes {
+		counts[i] = fmt.Sprintf("%d: %d", code, summary.StatusCodes[code])
+	}
+	return strings.Join(counts, ", ")
+}
+
+// GETErrorCategoryString lists GETErrorCategories in order of category, as
+// "dns: 3, timeout: 1". Errors from before categories were recorded, such
+// as cached ones, are counted as "unknown".
+func (summary Summary) GETErrorCategoryString() string {
+	categories := make([]string, 0, len(summary.GETErrorCategories))
+	for category := range summary.GETErrorCategories {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	counts := make([]string, len(categories))
+	for i, category := range categories {
+		name := category
+		if name == "" {
+			name = "unknown"
+		}
+		counts[i] = fmt.Sprintf("%s: %d", name, summary.GETErrorCategories[category])
+	}
+	return strings.Join(counts, ", ")
+}
+
+func (summary Summary) String() string {
+	s := fmt.Sprintf("%d records, %d with a DOI, %d skipped as already OA in Artudis, %d skipped by type, %d blank or comment lines; API OA: %d true, %d false; errors: %d GET, %d JSON decode, %d non-200 status, %d rejected lines; %d lookups saved by deduplication, %d skipped, %d over the request quota",
+		summary.Records, summary.RecordsWithDOI, summary.SkippedOA, summary.SkippedType, summary.SkippedLines, summary.APIOATrue, summary.APIOAFalse,
+		summary.GETErrors, summary.JSONDecodeErrors, summary.Non200Statuses, summary.RejectedLines,
+		summary.LookupsSaved, summary.LookupsSkipped, summary.QuotaExceeded)
+	if summary.BelowDataStandard > 0 {
+		s += fmt.Sprintf("; %d DOIs left out below the minimum data standard", summary.BelowDataStandard)
+	}
+	if summary.Panics > 0 {
+		s += fmt.Sprintf("; %d records left out after a panic", summary.Panics)
+	}
+	if len(summary.GETErrorCategories) > 0 {
+		s += "; GET errors: " + summary.GETErrorCategoryString()
+	}
+	if len(summary.StatusCodes) > 0 {
+		s += "; HTTP statuses: " + summary.StatusCodeString()
+	}
+	return s
+}
@@ -0,0 +1,53 @@
+package oadoi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// LoadTLSConfig returns a TLS configuration for a mirror of oaDOI that the
+// system doesn't trust: one that trusts the PEM certificates in caFile as
+// well as the system's, and if insecureSkipVerify is set, doesn't verify
+// servers at all, which lets anyone on the network answer in their place.
+// It returns nil, for the default configuration, if neither is given.
+func LoadTLSConfig(caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	if caFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// SetTLSConfig makes every request of the client, including those to
+// CrossRef and the head checks, use config. It only works with the
+// HTTPClient made by NewClient, or another using an *http.Transport.
+func (client *Client) SetTLSConfig(config *tls.Config) error {
+	if client.HTTPClient == nil {
+		return errors.New("can't configure TLS for the default HTTP client")
+	}
+	transport, ok := client.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("can't configure TLS for a custom HTTP transport")
+	}
+	transport.TLSClientConfig = config
+	return nil
+}
@@ -0,0 +1,174 @@
+package oadoi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// DefaultWebhookBatchSize is the number of records POSTed to a webhook at a
+// time if Processor.WebhookBatchSize isn't set.
+const DefaultWebhookBatchSize = 50
+
+// webhookRecordWriter writes every record to w, and POSTs them to url as
+// JSON arrays of up to batchSize records, each record as the json format
+// writes it. A batch is sent once it is full, and whatever has been
+// collected on Flush. Batches that can't be delivered are logged, and their
+// records written to failed if it is set, rather than stopping the main
+// report.
+type webhookRecordWriter struct {
+	w         RecordWriter
+	client    *Client
+	url       string
+	batchSize int
+	failed    RecordWriter
+
+	batch []Record
+}
+
+func (h *webhookRecordWriter) WriteHeader() error {
+	return h.w.WriteHeader()
+}
+
+func (h *webhookRecordWriter) Write(record Record) error {
+	h.batch = append(h.batch, record)
+	if len(h.batch) >= h.batchSize {
+		h.send()
+	}
+	return h.w.Write(record)
+}
+
+// Flush sends the records collected so far before flushing w, so that any
+// of them written to failed are flushed with the error file.
+func (h *webhookRecordWriter) Flush() error {
+	h.send()
+	return h.w.Flush()
+}
+
+func (h *webhookRecordWriter) send() {
+	if len(h.batch) == 0 {
+		return
+	}
+	batch := h.batch
+	h.batch = nil
+
+	// Delivery isn't tied to the run's context: records that are written
+	// after the run is stopped are still worth sending.
+	body, err := json.Marshal(batch)
+	if err == nil {
+		err = h.client.postWebhook(context.Background(), h.url, body)
+	}
+	if err == nil {
+		slog.Debug("Sent records to webhook", "records", len(batch))
+		return
+	}
+
+	slog.Error("Error sending records to webhook.", "records", len(batch), "first_id", batch[0].ID, "error", err)
+	if h.failed == nil {
+		return
+	}
+	for _, record := range batch {
+		err := h.failed.Write(record)
+		if err != nil {
+			slog.Error("Error writing undelivered record to the error file.", "id", record.ID, "error", err)
+			return
+		}
+	}
+}
+
+// postWebhook POSTs body to url, retrying network errors and 5xx responses
+// up to Retries times, and 429 responses until MaxRetryWait is used up, as
+// lookups are. Each attempt shares the concurrency, rate limit, timeout and
+// User-Agent of oaDOI requests.
+func (client *Client) postWebhook(ctx context.Context, url string, body []byte) error {
+	attempt, throttled := 0, 0
+	var waited time.Duration
+
+	for {
+		err := client.postWebhookOnce(ctx, url, body)
+		if err == nil || err == ErrNotAttempted {
+			return err
+		}
+
+		var delay time.Duration
+		statusErr, isStatus := err.(webhookStatusError)
+		if isStatus && statusErr.code == http.StatusTooManyRequests {
+			// As in fetch, a Retry-After of 0 still backs off, so that
+			// MaxRetryWait is used up.
+			delay = statusErr.retryAfter
+			if delay <= 0 {
+				delay = retryDelay(throttled)
+			}
+			throttled++
+			if waited+delay > client.MaxRetryWait {
+				return err
+			}
+			waited += delay
+		} else {
+			if attempt >= client.Retries || (isStatus && (statusErr.code < 500 || statusErr.code > 599)) {
+				return err
+			}
+			delay = retryDelay(attempt)
+			attempt++
+		}
+		slog.Debug("Retrying webhook", "error", err, "delay", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// webhookStatusError is a response from a webhook with a status other than
+// 2xx. retryAfter is how long a 429 response asked to wait, or negative if
+// it didn't say.
+type webhookStatusError struct {
+	code       int
+	status     string
+	retryAfter time.Duration
+}
+
+func (err webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook returned %s", err.status)
+}
+
+func (client *Client) postWebhookOnce(ctx context.Context, url string, body []byte) error {
+	release, ok := client.acquire(ctx)
+	if !ok {
+		return ErrNotAttempted
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", client.userAgent())
+
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webhookStatusError{
+			code:       resp.StatusCode,
+			status:     resp.Status,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return nil
+}
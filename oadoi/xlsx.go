@@ -0,0 +1,148 @@
+package oadoi
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"strconv"
+)
+
+// maxXLSXCell is the most characters Excel allows in a cell.
+const maxXLSXCell = 32767
+
+// xlsxWriter writes rows to a workbook with a single sheet. Every cell is a
+// string, so that ISSNs and the like keep their leading zeros. Rows are
+// streamed into the zip file as they are written; Flush finishes the
+// workbook, after which nothing more can be written.
+type xlsxWriter struct {
+	zip *zip.Writer
+	// frozenHeader freezes the first row, which is the header.
+	frozenHeader bool
+
+	sheet   io.Writer
+	rows    int
+	started bool
+	done    bool
+	err     error
+}
+
+func newXLSXWriter(w io.Writer, frozenHeader bool) *xlsxWriter {
+	return &xlsxWriter{zip: zip.NewWriter(w), frozenHeader: frozenHeader}
+}
+
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Report" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// start writes the parts of the workbook other than the sheet, and the
+// start of the sheet.
+func (x *xlsxWriter) start() {
+	x.started = true
+	for _, part := range xlsxParts {
+		x.writePart(part.name, part.content)
+	}
+	if x.err != nil {
+		return
+	}
+
+	x.sheet, x.err = x.zip.Create("xl/worksheets/sheet1.xml")
+	x.writeString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	if x.frozenHeader {
+		x.writeString(`<sheetViews><sheetView workbookViewId="0">` +
+			`<pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/>` +
+			`</sheetView></sheetViews>`)
+	}
+	x.writeString(`<sheetData>`)
+}
+
+func (x *xlsxWriter) writePart(name, content string) {
+	if x.err != nil {
+		return
+	}
+	var part io.Writer
+	part, x.err = x.zip.Create(name)
+	if x.err == nil {
+		_, x.err = io.WriteString(part, content)
+	}
+}
+
+func (x *xlsxWriter) writeString(s string) {
+	if x.err == nil {
+		_, x.err = io.WriteString(x.sheet, s)
+	}
+}
+
+func (x *xlsxWriter) Write(record []string) error {
+	if !x.started {
+		x.start()
+	}
+	if x.done {
+		x.err = io.ErrClosedPipe
+	}
+	if x.err != nil {
+		return x.err
+	}
+
+	x.rows++
+	rowNumber := strconv.Itoa(x.rows)
+	x.writeString(`<row r="` + rowNumber + `">`)
+	for i, value := range record {
+		if runes := []rune(value); len(runes) > maxXLSXCell {
+			value = string(runes[:maxXLSXCell])
+		}
+		x.writeString(`<c r="` + xlsxColumnName(i) + rowNumber + `" t="inlineStr"><is><t xml:space="preserve">`)
+		if x.err == nil {
+			x.err = xml.EscapeText(x.sheet, []byte(value))
+		}
+		x.writeString(`</t></is></c>`)
+	}
+	x.writeString(`</row>`)
+	return x.err
+}
+
+// Flush finishes the workbook.
+func (x *xlsxWriter) Flush() {
+	if x.done {
+		return
+	}
+	if !x.started {
+		x.start()
+	}
+	x.done = true
+	x.writeString(`</sheetData></worksheet>`)
+	err := x.zip.Close()
+	if x.err == nil {
+		x.err = err
+	}
+}
+
+func (x *xlsxWriter) Error() error {
+	return x.err
+}
+
+// xlsxColumnName is the letter name of the column with index i: A to Z,
+// then AA and so on.
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
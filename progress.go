@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artudis-utils/artudis-oadoi-report/oadoi"
+)
+
+// openProgressJSON opens a file path, or an already-open descriptor given as
+// fd:N, for the progress stream.
+func openProgressJSON(target string) (io.WriteCloser, error) {
+	if strings.HasPrefix(target, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, "fd:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid file descriptor %q", target)
+		}
+		return os.NewFile(uintptr(fd), target), nil
+	}
+	return os.Create(target)
+}
+
+// startProgressJSON writes a progress report as a line of JSON every
+// interval, and once more when the returned stop function is called.
+func startProgressJSON(progress *oadoi.Progress, w io.Writer, interval time.Duration) func() {
+	encoder := json.NewEncoder(w)
+	return startProgress(progress, interval, func(report oadoi.ProgressReport) {
+		err := encoder.Encode(report)
+		if err != nil {
+			slog.Error("Error writing progress.", "error", err)
+		}
+	})
+}
+
+// startProgressLog logs a progress report every interval, and once more
+// when the returned stop function is called.
+func startProgressLog(progress *oadoi.Progress, interval time.Duration) func() {
+	return startProgress(progress, interval, func(report oadoi.ProgressReport) {
+		slog.Info("Progress.",
+			"records", report.RecordsDone,
+			"lookups", report.Lookups,
+			"records_per_second", fmt.Sprintf("%.1f", report.RecordsPerSecond),
+			"errors", report.Errors)
+	})
+}
+
+// startProgress calls write with a progress report every interval, and once
+// more when the returned stop function is called.
+func startProgress(progress *oadoi.Progress, interval time.Duration, write func(oadoi.ProgressReport)) func() {
+	start := time.Now()
+	done := make(chan bool)
+	var waitgroup sync.WaitGroup
+	waitgroup.Add(1)
+	go func() {
+		defer waitgroup.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				write(progress.Report(start, time.Now()))
+			case <-done:
+				write(progress.Report(start, time.Now()))
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		waitgroup.Wait()
+	}
+}
+
+// stderrIsTerminal reports whether standard error is a terminal, where
+// someone is likely to be watching the run.
+func stderrIsTerminal() bool {
+	fileInfo, err := os.Stderr.Stat()
+	return err == nil && fileInfo.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// reportWriter is where the report goes: a file or stdout, optionally gzip
+// compressed. Close flushes and closes the gzip stream before the file, and
+// is safe to call more than once.
+type reportWriter struct {
+	w          io.Writer
+	file       *os.File
+	gzipWriter *gzip.Writer
+	closeOnce  sync.Once
+	closeErr   error
+	// appended is set if the report is being added to the end of a file
+	// that already had something in it, so needs no header.
+	appended bool
+}
+
+// openReport opens the -o file, or stdout if fileName is empty. The report
+// is compressed if compress is set or the file name ends in .gz; a
+// compressed report appended to a gzipped file is a second gzip member,
+// which gzip reads as one stream.
+func openReport(fileName string, noClobber bool, appending bool, compress bool) (*reportWriter, error) {
+	report := &reportWriter{file: os.Stdout}
+
+	if fileName != "" {
+		openFlags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if noClobber {
+			openFlags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		} else if appending {
+			openFlags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		file, err := os.OpenFile(fileName, openFlags, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if appending {
+			fileInfo, err := file.Stat()
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			report.appended = fileInfo.Size() > 0
+		}
+		report.file = file
+		compress = compress || strings.HasSuffix(fileName, ".gz")
+	}
+
+	report.w = report.file
+	if compress {
+		report.gzipWriter = gzip.NewWriter(report.file)
+		report.w = report.gzipWriter
+	}
+	return report, nil
+}
+
+func (report *reportWriter) Write(p []byte) (int, error) {
+	return report.w.Write(p)
+}
+
+func (report *reportWriter) Close() error {
+	report.closeOnce.Do(func() {
+		if report.gzipWriter != nil {
+			report.closeErr = report.gzipWriter.Close()
+		}
+		if report.file != os.Stdout {
+			err := report.file.Close()
+			if report.closeErr == nil {
+				report.closeErr = err
+			}
+		}
+	})
+	return report.closeErr
+}
+
+// splitReportName is the -split report for an input file: a sibling of it,
+// with Publication-export.json replaced by oadoi-report and an extension for
+// the format, so foo-Publication-export.json.gz becomes foo-oadoi-report.csv.
+// flatjson reports are given the extension jsonl.
+func splitReportName(fileName string, format string, compress bool) string {
+	dir, base := filepath.Split(fileName)
+	base = strings.TrimSuffix(base, ".gz")
+	if strings.HasSuffix(base, "Publication-export.json") {
+		base = strings.TrimSuffix(base, "Publication-export.json") + "oadoi-report"
+	} else {
+		base = strings.TrimSuffix(base, filepath.Ext(base)) + "-oadoi-report"
+	}
+
+	extension := format
+	if format == "flatjson" {
+		extension = "jsonl"
+	}
+	name := filepath.Join(dir, base+"."+extension)
+	if compress {
+		name += ".gz"
+	}
+	return name
+}
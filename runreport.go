@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/artudis-utils/artudis-oadoi-report/oadoi"
+)
+
+// secretFlags are flags whose values are left out of the run report:
+// -input-header is often an Authorization header.
+var secretFlags = map[string]bool{"sherpa-key": true, "input-header": true}
+
+// A runReport describes a finished run, for -report-file, so that a
+// scheduler can check on it without reading the log.
+type runReport struct {
+	Version         string    `json:"version"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	InputFiles      []string  `json:"input_files"`
+	// Interrupted is set if the run was stopped by a signal before every
+	// record was looked up.
+	Interrupted bool      `json:"interrupted"`
+	ExitStatus  int       `json:"exit_status"`
+	Counts      runCounts `json:"counts"`
+	Errors      runErrors `json:"errors"`
+	// Config is the value of every flag, whether set on the command line,
+	// by the config file or by default, except secretFlags, which are only
+	// marked as set or not. URLs, here and in InputFiles, go through
+	// redactURL.
+	Config map[string]string `json:"config"`
+}
+
+type runCounts struct {
+	Records           int   `json:"records"`
+	RecordsWithDOI    int   `json:"records_with_doi"`
+	Requests          int64 `json:"requests"`
+	Succeeded         int   `json:"succeeded"`
+	Failed            int   `json:"failed"`
+	APIOATrue         int   `json:"api_oa_true"`
+	APIOAFalse        int   `json:"api_oa_false"`
+	ArtudisOATrue     int   `json:"artudis_oa_true"`
+	OAMismatches      int   `json:"oa_mismatches"`
+	LookupsSaved      int   `json:"lookups_saved"`
+	LookupsSkipped    int   `json:"lookups_skipped"`
+	QuotaExceeded     int   `json:"quota_exceeded"`
+	SkippedOA         int   `json:"skipped_oa"`
+	SkippedType       int   `json:"skipped_type"`
+	SkippedLines      int   `json:"skipped_lines"`
+	RejectedLines     int   `json:"rejected_lines"`
+	BelowDataStandard int   `json:"below_data_standard"`
+}
+
+type runErrors struct {
+	GET                int            `json:"get"`
+	JSONDecode         int            `json:"json_decode"`
+	Non200Statuses     int            `json:"non_200_statuses"`
+	StatusCodes        map[int]int    `json:"status_codes"`
+	GETErrorCategories map[string]int `json:"get_error_categories"`
+	Panics             int            `json:"panics"`
+}
+
+func newRunReport(startedAt time.Time, finishedAt time.Time, inputFiles []string, total oadoi.Summary, requests int64, interrupted bool, exitStatus int, flags *flag.FlagSet) runReport {
+	report := runReport{
+		Version:         version,
+		StartedAt:       startedAt.UTC(),
+		FinishedAt:      finishedAt.UTC(),
+		DurationSeconds: finishedAt.Sub(startedAt).Seconds(),
+		InputFiles:      append([]string(nil), inputFiles...),
+		Interrupted:     interrupted,
+		ExitStatus:      exitStatus,
+		Counts: runCounts{
+			Records:           total.Records,
+			RecordsWithDOI:    total.RecordsWithDOI,
+			Requests:          requests,
+			Succeeded:         total.Succeeded,
+			Failed:            total.Failed,
+			APIOATrue:         total.APIOATrue,
+			APIOAFalse:        total.APIOAFalse,
+			ArtudisOATrue:     total.ArtudisOATrue,
+			OAMismatches:      total.OAMismatches,
+			LookupsSaved:      total.LookupsSaved,
+			LookupsSkipped:    total.LookupsSkipped,
+			QuotaExceeded:     total.QuotaExceeded,
+			SkippedOA:         total.SkippedOA,
+			SkippedType:       total.SkippedType,
+			SkippedLines:      total.SkippedLines,
+			RejectedLines:     total.RejectedLines,
+			BelowDataStandard: total.BelowDataStandard,
+		},
+		Errors: runErrors{
+			GET:                total.GETErrors,
+			JSONDecode:         total.JSONDecodeErrors,
+			Non200Statuses:     total.Non200Statuses,
+			StatusCodes:        total.StatusCodes,
+			GETErrorCategories: total.GETErrorCategories,
+			Panics:             total.Panics,
+		},
+		Config: map[string]string{},
+	}
+
+	for i, fileName := range report.InputFiles {
+		report.InputFiles[i] = redactURL(fileName)
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "(set)"
+		}
+		report.Config[f.Name] = redactURL(value)
+	})
+	return report
+}
+
+// redactURL hides the query string and password of value if it is an http
+// or https URL, such as -webhook-url or an input, where gateways often take
+// a token.
+func redactURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return value
+	}
+	if parsed.RawQuery != "" {
+		parsed.RawQuery = "(set)"
+	}
+	return parsed.Redacted()
+}
+
+// writeRunReport writes report to fileName as indented JSON.
+func writeRunReport(fileName string, report runReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, append(data, '\n'), 0644)
+}